@@ -22,12 +22,32 @@ import (
 	"github.com/vkuznet/transfer2go/utils"
 )
 
+// NotBefore and Deadline define time constraints of submitted transfer
+// requests, they are either time stamps (RFC3339) or durations from now, e.g. 2h
+var NotBefore, Deadline string
+
+// helper function to convert time stamp (RFC3339) or duration from now into Unix time
+func parseTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(d).Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %s, expect RFC3339 time stamp or duration", value)
+	}
+	return t.Unix(), nil
+}
+
 // ActionRequest provides structure submitted by clients to perform certain action on main agent
 type ActionRequest struct {
 	Delay    int    `json:"delay"`    // transfer delay time, i.e. post-pone transfer
 	Id       string `json:"id"`       // unique id of each request
 	Priority int    `json:"priority"` // priority of request
 	Action   string `json:"action"`   // which action to apply
+	Comment  string `json:"comment"`  // comment of the action, e.g. reason of rejection
 }
 
 // AgentFiles holds agent alias/url and list of files to transfer
@@ -128,21 +148,27 @@ func findFiles(agents map[string]string, src string) ([]AgentFiles, error) {
 // helper function to find remote agents
 func findAgents(agent string) map[string]string {
 
-	// find out list of all agents
-	url := fmt.Sprintf("%s/agents", agent)
+	// find out records of all agents, agents whose heartbeats expired are skipped
+	url := fmt.Sprintf("%s/heartbeat", agent)
 	resp := utils.FetchResponse(url, []byte{})
 	if resp.Error != nil {
 		log.WithFields(log.Fields{
 			"Agent": agent,
 		}).Error("Unable to get list of agents")
 	}
-	var remoteAgents map[string]string
-	e := json.Unmarshal(resp.Data, &remoteAgents)
+	var records []core.AgentRecord
+	e := json.Unmarshal(resp.Data, &records)
 	if e != nil {
 		log.WithFields(log.Fields{
 			"Agent": agent,
 		}).Error("Unable to unmarshal response from agent")
 	}
+	remoteAgents := make(map[string]string)
+	for _, rec := range records {
+		if rec.State == core.AgentAlive {
+			remoteAgents[rec.Alias] = rec.Url
+		}
+	}
 	return remoteAgents
 }
 
@@ -203,6 +229,13 @@ func parseRequest(agent, src, dst string) (core.TransferRequest, error) {
 		return req, fmt.Errorf("Name resolution problem")
 	}
 	req = core.TransferRequest{RegUrl: agent, RegAlias: agentAlias, SrcUrl: srcUrl, SrcAlias: srcAlias, DstUrl: dstUrl, DstAlias: dstAlias}
+	var err error
+	if req.NotBefore, err = parseTime(NotBefore); err != nil {
+		return req, err
+	}
+	if req.Deadline, err = parseTime(Deadline); err != nil {
+		return req, err
+	}
 	if strings.Contains(data, "#") { // it is a block name, e.g. /a/b/c#123
 		req.Block = data
 	} else if strings.Count(data, "/") == 3 { // it is a dataset
@@ -403,25 +436,29 @@ func ProcessAction(agent, jsonString string) {
 		}).Error("Error unable to unmarshal input json string")
 		return
 	}
+	SendAction(agent, req)
+}
+
+// SendAction sends given action on request to the agent
+func SendAction(agent string, req ActionRequest) {
 	rid := req.Id
 	if rid == "" {
 		log.WithFields(log.Fields{
-			"JSON":  jsonString,
-			"Error": err,
+			"Action": req.Action,
 		}).Error("unknown request Id")
 		return
 	}
-	if req.Action != "approve" && req.Action != "delete" {
+	if !utils.InList(req.Action, []string{"approve", "reject", "delete", "cancel", "retry", "priority"}) {
 		log.WithFields(log.Fields{
-			"JSON":   jsonString,
+			"Id":     rid,
 			"Action": req.Action,
 		}).Error("unknown action")
 		return
 	}
 	furl := fmt.Sprintf("%s/action", agent)
 	var jobs []core.Job
-	r := core.TransferRequest{Id: rid}
-	job := core.Job{TransferRequest: r, Action: req.Action}
+	r := core.TransferRequest{Id: rid, Priority: req.Priority}
+	job := core.Job{TransferRequest: r, Action: req.Action, Comment: req.Comment}
 	jobs = append(jobs, job)
 	d, e := json.Marshal(jobs)
 	if e != nil {
@@ -451,13 +488,21 @@ func ProcessAction(agent, jsonString string) {
 
 // ShowRequests list request of a given type from an agent
 func ShowRequests(agent, rtype string) {
-	furl := fmt.Sprintf("%s/list?type=%s", agent, url.QueryEscape(rtype))
+	showRequests(fmt.Sprintf("%s/list?type=%s", agent, url.QueryEscape(rtype)))
+}
+
+// ShowGroup list requests derived from given parent request
+func ShowGroup(agent, parent string) {
+	showRequests(fmt.Sprintf("%s/list?parent=%s", agent, url.QueryEscape(parent)))
+}
+
+// helper function to list requests from given url
+func showRequests(furl string) {
 	var args []byte
 	resp := utils.FetchResponse(furl, args)
 	if resp.Error != nil || resp.StatusCode != 200 {
 		log.WithFields(log.Fields{
 			"Url":   furl,
-			"Type":  rtype,
 			"Error": resp.Error,
 		}).Error("Error while fetching list of request from the agent")
 		return
@@ -467,12 +512,58 @@ func ShowRequests(agent, rtype string) {
 	if err != nil {
 		log.WithFields(log.Fields{
 			"Url":   furl,
-			"Type":  rtype,
 			"Error": resp.Error,
 		}).Error("Error during unmarshalling HTTP response")
 		return
 	}
 	for _, r := range requests {
+		if r.Progress != nil {
+			log.WithFields(log.Fields{
+				"Progress": r.Progress.String(),
+			}).Info(r.String())
+			continue
+		}
 		log.Info(r.String())
 	}
 }
+
+// ShowApprovals lists pending requests of the agent along with their approvals
+func ShowApprovals(agent string) {
+	furl := fmt.Sprintf("%s/approvals", agent)
+	var args []byte
+	resp := utils.FetchResponse(furl, args)
+	if resp.Error != nil || resp.StatusCode != 200 {
+		log.WithFields(log.Fields{
+			"Url":   furl,
+			"Error": resp.Error,
+		}).Error("Error while fetching pending approvals from the agent")
+		return
+	}
+	var approvals []core.PendingApproval
+	err := json.Unmarshal(resp.Data, &approvals)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Url":   furl,
+			"Error": err,
+		}).Error("Error during unmarshalling HTTP response")
+		return
+	}
+	for _, p := range approvals {
+		log.WithFields(log.Fields{
+			"Id":        p.Request.Id,
+			"User":      p.Request.User,
+			"Dst":       p.Request.DstAlias,
+			"Bytes":     p.Request.Bytes,
+			"Approvals": len(p.Approvals),
+			"Missing":   p.Missing,
+		}).Info("pending approval")
+		for _, a := range p.Approvals {
+			log.WithFields(log.Fields{
+				"Approver": a.User,
+				"Roles":    a.Roles,
+				"Decision": a.Decision,
+				"Comment":  a.Comment,
+			}).Info("  decision")
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package core
+
+// transfer2go approval workflow of transfer requests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// approval decisions
+const (
+	Approve = "approve"
+	Reject  = "reject"
+)
+
+// Approval represents decision of approver on transfer request
+type Approval struct {
+	Request   string   `json:"request"`  // request id
+	User      string   `json:"user"`     // approver DN
+	Roles     []string `json:"roles"`    // roles of approver at the time of decision
+	Decision  string   `json:"decision"` // approve or reject
+	Comment   string   `json:"comment"`  // approver comment
+	TimeStamp int64    `json:"ts"`       // time stamp of the decision
+}
+
+// ApprovalRule defines roles which must approve requests to given destination
+// sites or requests of given size
+type ApprovalRule struct {
+	Sites    []string `json:"sites"`    // destination sites, empty list or "*" matches all sites
+	MinBytes int64    `json:"minBytes"` // rule applies to requests of at least given size
+	Roles    []string `json:"roles"`    // roles which must approve the request
+}
+
+// ApprovalPolicy defines approval rules, all matching rules must be satisfied.
+// Every required role should be signed off by different approver, admin may
+// sign off any role. Requests without matching rule require single approval.
+type ApprovalPolicy struct {
+	Rules []ApprovalRule `json:"rules"`
+}
+
+// PendingApproval represents request which waits for approvals
+type PendingApproval struct {
+	Request   TransferRequest `json:"request"`   // transfer request
+	Approvals []Approval      `json:"approvals"` // approval decisions so far
+	Missing   []string        `json:"missing"`   // roles which still should approve the request
+}
+
+// AgentApprovals holds approval policy of the agent, nil policy requires single approval
+var AgentApprovals *ApprovalPolicy
+
+// LoadApprovals reads approval policy from given file, empty file name returns nil policy
+func LoadApprovals(fname string) (*ApprovalPolicy, error) {
+	if fname == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var p ApprovalPolicy
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range p.Rules {
+		for _, role := range r.Roles {
+			if !utils.InList(role, allRoles) {
+				return nil, fmt.Errorf("Unknown role %s", role)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Required returns roles which must approve given request, size of the
+// request is expected to be provided by the agent rather than by the client
+func (p *ApprovalPolicy) Required(t TransferRequest) []string {
+	var roles []string
+	if p == nil {
+		return roles
+	}
+	for _, r := range p.Rules {
+		if len(r.Sites) > 0 && !utils.InList("*", r.Sites) && !utils.InList(t.DstAlias, r.Sites) {
+			continue
+		}
+		if t.Bytes < r.MinBytes {
+			continue
+		}
+		for _, role := range r.Roles {
+			if !utils.InList(role, roles) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// helper function to get last decision of every approver
+func decisions(approvals []Approval) []Approval {
+	var out []Approval
+	index := make(map[string]int)
+	for _, a := range approvals {
+		if i, ok := index[a.User]; ok {
+			out[i] = a
+			continue
+		}
+		index[a.User] = len(out)
+		out = append(out, a)
+	}
+	return out
+}
+
+// Missing returns roles which still should approve given request
+func (p *ApprovalPolicy) Missing(t TransferRequest, approvals []Approval) []string {
+	var approvers []Approval
+	for _, a := range decisions(approvals) {
+		if a.Decision == Approve {
+			approvers = append(approvers, a)
+		}
+	}
+	required := p.Required(t)
+	if len(required) == 0 {
+		if len(approvers) == 0 {
+			return []string{"any"}
+		}
+		return nil
+	}
+	// every approver signs off a single role, approvers with exact role
+	// are preferred over admins
+	used := make(map[string]bool)
+	var missing []string
+	for _, role := range required {
+		signer := ""
+		for _, a := range approvers {
+			if used[a.User] {
+				continue
+			}
+			if utils.InList(role, a.Roles) {
+				signer = a.User
+				break
+			}
+			if signer == "" && utils.InList(RoleAdmin, a.Roles) {
+				signer = a.User
+			}
+		}
+		if signer == "" {
+			missing = append(missing, role)
+			continue
+		}
+		used[signer] = true
+	}
+	return missing
+}
+
+// Rejected returns rejection of given request if any
+func Rejected(approvals []Approval) (Approval, bool) {
+	for _, a := range decisions(approvals) {
+		if a.Decision == Reject {
+			return a, true
+		}
+	}
+	return Approval{}, false
+}
+
+// Decide records decision of given user on given request and returns true
+// when request is approved and should be dispatched. Rejected request is
+// removed from the queue. Only data managers of destination site may decide
+// on the request, and request which is already approved can't be decided again.
+func Decide(t TransferRequest, u User, decision, comment string) (bool, error) {
+	if t.Status == "" {
+		return false, fmt.Errorf("Unknown request %s", t.Id)
+	}
+	if t.Status != "pending" {
+		return false, fmt.Errorf("Request %s is %s, only pending requests can be approved or rejected", t.Id, t.Status)
+	}
+	approvals, err := TFC.Approvals(t.Id)
+	if err != nil {
+		return false, err
+	}
+	if len(AgentApprovals.Missing(t, approvals)) == 0 {
+		return false, fmt.Errorf("Request %s is already approved", t.Id)
+	}
+	if !AgentPolicy.SiteManager(u, t.DstAlias) {
+		return false, fmt.Errorf("User %s is not data manager of site %s", u.Name, t.DstAlias)
+	}
+	roles := []string{RoleAdmin} // nil policy allows everything
+	if AgentPolicy != nil {
+		roles = AgentPolicy.UserRoles(u)
+	}
+	a := Approval{Request: t.Id, User: u.Name, Roles: roles, Decision: decision, Comment: comment, TimeStamp: time.Now().Unix()}
+	err = TFC.InsertApproval(a)
+	if err != nil {
+		return false, err
+	}
+	logs.WithFields(logs.Fields{
+		"Request":  t.Id,
+		"User":     u.Name,
+		"Roles":    roles,
+		"Decision": decision,
+		"Comment":  comment,
+	}).Info("Approval decision")
+	if decision == Reject {
+		err = TFC.UpdateRequest(t.Id, "rejected")
+		if err == nil {
+			RequestQueueLock.Lock()
+			RequestQueue.Delete(t.Id)
+			RequestQueueLock.Unlock()
+		}
+		return false, err
+	}
+	missing := AgentApprovals.Missing(t, append(approvals, a))
+	if len(missing) > 0 {
+		logs.WithFields(logs.Fields{
+			"Request": t.Id,
+			"Missing": missing,
+		}).Info("Request waits for approvals")
+		return false, nil
+	}
+	return true, nil
+}
+
+// PendingApprovals returns pending requests along with their approvals
+func PendingApprovals() ([]PendingApproval, error) {
+	requests, err := TFC.ListRequest("pending")
+	if err != nil {
+		return nil, err
+	}
+	var out []PendingApproval
+	for _, t := range requests {
+		approvals, err := TFC.Approvals(t.Id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, PendingApproval{Request: t, Approvals: approvals, Missing: AgentApprovals.Missing(t, approvals)})
+	}
+	return out, nil
+}
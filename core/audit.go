@@ -0,0 +1,98 @@
+package core
+
+// transfer2go audit log, it records every state-changing operation of the agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	logs "github.com/sirupsen/logrus"
+)
+
+// outcomes of audited operation
+const (
+	AuditSuccess = "success" // operation succeeded
+	AuditFailure = "failure" // operation failed
+	AuditDenied  = "denied"  // user is not allowed to perform operation
+)
+
+// AuditRecord represents single audited operation
+type AuditRecord struct {
+	TimeStamp int64    `json:"ts"`       // time stamp of the operation
+	User      string   `json:"user"`     // user DN or token subject
+	Agent     string   `json:"agent"`    // alias of the agent which performed operation
+	Endpoint  string   `json:"endpoint"` // agent endpoint
+	Method    string   `json:"method"`   // HTTP method
+	Action    string   `json:"action"`   // operation, e.g. approve, by default it is endpoint name
+	Requests  []string `json:"requests"` // ids of affected requests
+	Status    int      `json:"status"`   // HTTP status code
+	Outcome   string   `json:"outcome"`  // outcome of the operation: success, failure or denied
+}
+
+// AuditLog is append-only log of audit records, records are stored in AUDIT
+// table and optionally in a file in JSON-lines format
+type AuditLog struct {
+	sync.Mutex
+	File string   // JSON-lines file name
+	fh   *os.File // file handler
+}
+
+// AgentAudit holds audit log of the agent
+var AgentAudit = &AuditLog{}
+
+// String provides string representation of audit record
+func (a *AuditRecord) String() string {
+	return fmt.Sprintf("<AuditRecord ts=%d user=%s agent=%s endpoint=%s method=%s action=%s requests=%v status=%d outcome=%s>", a.TimeStamp, a.User, a.Agent, a.Endpoint, a.Method, a.Action, a.Requests, a.Status, a.Outcome)
+}
+
+// NewAuditLog returns new instance of AuditLog, empty file name means that
+// records are stored in DB only
+func NewAuditLog(fname string) (*AuditLog, error) {
+	a := &AuditLog{File: fname}
+	if fname != "" {
+		fh, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.fh = fh
+	}
+	return a, nil
+}
+
+// Record appends given record to audit log
+func (a *AuditLog) Record(rec AuditRecord) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.fh != nil {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		_, err = a.fh.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	if DB != nil {
+		return TFC.InsertAudit(rec)
+	}
+	return nil
+}
+
+// Close closes audit log file
+func (a *AuditLog) Close() {
+	a.Lock()
+	defer a.Unlock()
+	if a.fh != nil {
+		err := a.fh.Close()
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"File":  a.File,
+				"Error": err,
+			}).Error("Unable to close audit log")
+		}
+		a.fh = nil
+	}
+}
@@ -3,7 +3,259 @@ package core
 // transfer2go auth data transfer module
 // Author - Valentin Kuznetsov <vkuznet@gmail.com>
 
-import logs "github.com/sirupsen/logrus"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// roles used by authorization policy
+const (
+	RoleAdmin     = "admin"         // full control of the agent
+	RoleOperator  = "site-operator" // operates the site, e.g. approves requests, registers agents
+	RoleRequester = "requester"     // submits transfer requests
+	RoleReader    = "read-only"     // reads agent information
+	RoleAgent     = "agent"         // another agent, this role is given to verified agent certificates only
+)
+
+// prefixes used in role members to refer to a group of users or a token scope,
+// names of token users carry token prefix
+const (
+	groupPrefix = "group:"
+	scopePrefix = "scope:"
+	tokenPrefix = "token:"
+)
+
+// User represents authenticated user
+type User struct {
+	Name   string   // user DN or token subject prefixed by "token:"
+	Agent  string   // host name of the agent if user presents verified agent certificate
+	Groups []string // user groups provided by the token
+	Scopes []string // token scopes
+}
+
+// AgentPolicy holds authorization policy of the agent, nil policy allows everything
+var AgentPolicy *Policy
+
+// Policy represents authorization policy of the agent. The roles are mapped to
+// user DNs, groups (group:name) or token scopes (scope:name), the endpoints and actions are mapped to roles
+// allowed to use them. The endpoint keys may be qualified by HTTP method, e.g.
+// "POST tfc", such rule takes precedence over endpoint rule. The sites are
+// mapped to their data managers in the same way as roles.
+type Policy struct {
+	Roles     map[string][]string `json:"roles"`     // role and list of its DNs, groups or scopes
+	Groups    map[string][]string `json:"groups"`    // group and list of its DNs
+	Sites     map[string][]string `json:"sites"`     // site alias and list of its data managers
+	Endpoints map[string][]string `json:"endpoints"` // endpoint and list of allowed roles
+	Actions   map[string][]string `json:"actions"`   // request action and list of allowed roles
+}
+
+// all roles, it is used by default rules of read-only endpoints
+var allRoles = []string{RoleAdmin, RoleOperator, RoleRequester, RoleReader}
+
+// all roles and agents, it is used by rules of read-only endpoints which
+// agents call on each other
+var agentReadRoles = []string{RoleAdmin, RoleOperator, RoleRequester, RoleReader, RoleAgent}
+
+// DefaultEndpoints defines roles allowed to use agent endpoints, they are used
+// if policy does not provide its own rule
+var DefaultEndpoints = map[string][]string{
+	"reset":           {RoleAdmin},
+	"verbose":         {RoleAdmin},
+	"protocol":        {RoleAdmin},
+	"POST tfc":        {RoleAdmin, RoleOperator, RoleAgent},
+	"identities":      {RoleAdmin, RoleOperator},
+	"POST identities": {RoleAdmin},
+	"audit":           {RoleAdmin, RoleOperator},
+	"quota":           allRoles,
+	"status":          agentReadRoles,
+	"download":        agentReadRoles,
+	"lfn2pfn":         agentReadRoles,
+	"probe":           agentReadRoles,
+	"links":           agentReadRoles,
+	"history":         agentReadRoles,
+	"POST shares":     {RoleAdmin},
+	"POST limits":     {RoleAdmin},
+	"POST catalog":    {RoleAdmin, RoleOperator},
+	"records":         {RoleAdmin, RoleOperator, RoleRequester, RoleAgent},
+	"register":        {RoleAdmin, RoleOperator, RoleAgent},
+	"gossip":          {RoleAdmin, RoleOperator, RoleAgent},
+	"upload":          {RoleAdmin, RoleOperator, RoleAgent},
+	"request":         {RoleAdmin, RoleOperator, RoleRequester},
+	"pull":            {RoleAdmin, RoleOperator, RoleRequester},
+	"push":            {RoleAdmin, RoleOperator, RoleRequester},
+	"action":          {RoleAdmin, RoleOperator, RoleRequester, RoleAgent},
+}
+
+// DefaultActions defines roles allowed to perform request actions, they are
+// used if policy does not provide its own rule
+var DefaultActions = map[string][]string{
+	"approve":      {RoleAdmin, RoleOperator},
+	"reject":       {RoleAdmin, RoleOperator},
+	"cancel":       {RoleAdmin, RoleOperator, RoleRequester},
+	"retry":        {RoleAdmin, RoleOperator, RoleRequester},
+	"priority":     {RoleAdmin, RoleOperator},
+	"delete":       {RoleAdmin, RoleOperator, RoleRequester},
+	"transfer":     {RoleAdmin, RoleOperator, RoleAgent},
+	"update":       {RoleAdmin, RoleOperator, RoleAgent},
+	"cleanup":      {RoleAdmin, RoleOperator, RoleAgent},
+	"abort":        {RoleAdmin, RoleOperator, RoleAgent},
+	"reprioritize": {RoleAdmin, RoleOperator, RoleAgent},
+}
+
+// AgentEndpoints lists endpoints which are used by agents only, when mutual TLS
+// is configured they require verified agent certificate
+var AgentEndpoints = []string{"upload", "gossip", "register"}
+
+// AgentActions lists request actions which are performed by agents only
+var AgentActions = []string{"transfer", "update", "cleanup", "abort", "reprioritize"}
+
+// AgentEndpoint checks if given endpoint is used by agents only
+func AgentEndpoint(method, endpoint string) bool {
+	return utils.InList(endpoint, AgentEndpoints) || utils.InList(fmt.Sprintf("%s %s", method, endpoint), AgentEndpoints)
+}
+
+// LoadPolicy reads authorization policy from given file, empty file name
+// returns nil policy which allows everything
+func LoadPolicy(fname string) (*Policy, error) {
+	if fname == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, err
+	}
+	for role := range p.Roles {
+		if !utils.InList(role, allRoles) {
+			return nil, fmt.Errorf("Unknown role %s", role)
+		}
+	}
+	return &p, nil
+}
+
+// UserRoles returns list of roles of given user
+func (p *Policy) UserRoles(u User) []string {
+	var roles []string
+	if u.Agent != "" {
+		roles = append(roles, RoleAgent)
+	}
+	for role, members := range p.Roles {
+		for _, m := range members {
+			if p.member(u, m) {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// Admin checks if given user is admin, nil policy allows everything
+func (p *Policy) Admin(u User) bool {
+	return p == nil || utils.InList(RoleAdmin, p.UserRoles(u))
+}
+
+// SiteManager checks if given user manages data of given site, admin manages
+// all sites
+func (p *Policy) SiteManager(u User, site string) bool {
+	if p.Admin(u) {
+		return true
+	}
+	for _, m := range p.Sites[site] {
+		if p.member(u, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to check if user matches role member, i.e. user DN, group or scope
+func (p *Policy) member(u User, m string) bool {
+	if strings.HasPrefix(m, scopePrefix) {
+		return utils.InList(strings.TrimPrefix(m, scopePrefix), u.Scopes)
+	}
+	if strings.HasPrefix(m, groupPrefix) {
+		group := strings.TrimPrefix(m, groupPrefix)
+		return utils.InList(u.Name, p.Groups[group]) || utils.InList(group, u.Groups) || utils.InList(group, AgentIdentities.Groups(u.Name))
+	}
+	return m == u.Name
+}
+
+// helper function to check if user has one of allowed roles, admin is allowed everything
+func (p *Policy) allowed(u User, allowed []string) bool {
+	for _, role := range p.UserRoles(u) {
+		if role == RoleAdmin || utils.InList(role, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to find a rule in policy or default rules
+func rule(key string, rules, defaults map[string][]string) ([]string, bool) {
+	if roles, ok := rules[key]; ok {
+		return roles, true
+	}
+	roles, ok := defaults[key]
+	return roles, ok
+}
+
+// Endpoint checks if given user is allowed to access given endpoint
+// with given HTTP method. Endpoints without a rule are readable by every role
+// while other methods on them are allowed to admin only.
+func (p *Policy) Endpoint(u User, method, endpoint string) bool {
+	if p == nil {
+		return true
+	}
+	roles, ok := rule(fmt.Sprintf("%s %s", method, endpoint), p.Endpoints, DefaultEndpoints)
+	if !ok {
+		roles, ok = rule(endpoint, p.Endpoints, DefaultEndpoints)
+	}
+	if !ok {
+		roles = []string{RoleAdmin}
+		if method == "GET" {
+			roles = allRoles
+		}
+	}
+	status := p.allowed(u, roles)
+	if !status {
+		logs.WithFields(logs.Fields{
+			"User":     u.Name,
+			"Method":   method,
+			"Endpoint": endpoint,
+		}).Warn("Access to endpoint is denied")
+	}
+	return status
+}
+
+// Action checks if given user is allowed to perform given request action,
+// actions without a rule are allowed to admin only
+func (p *Policy) Action(u User, action string) bool {
+	if p == nil {
+		return true
+	}
+	roles, ok := rule(action, p.Actions, DefaultActions)
+	if !ok {
+		roles = []string{RoleAdmin}
+	}
+	status := p.allowed(u, roles)
+	if !status {
+		logs.WithFields(logs.Fields{
+			"User":   u.Name,
+			"Action": action,
+		}).Warn("Action is denied")
+	}
+	return status
+}
 
 // CallerFunc type func(string, string, string)
 type CallerFunc func(agent, src, dst string)
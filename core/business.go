@@ -5,12 +5,14 @@ package core
 
 import (
 	"container/heap"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/fgrid/uuid"
@@ -48,41 +50,58 @@ type TransferRequest struct {
 	Id        string `json:"id"`       // unique id of each request
 	Priority  int    `json:"priority"` // priority of request
 	Status    string `json:"status"`   // Identify the category of request
+	Route     []Hop  `json:"route"`    // remaining hops to reach final destination of multi-hop transfer
+	Relays    []Hop  `json:"relays"`   // intermediate agents which hold temporary replicas
+	User      string `json:"user"`     // user (DN or token subject) who submitted the request
+	Bytes     int64  `json:"bytes"`    // size of requested data in bytes
+	Parent    string `json:"parent"`   // id of parent request (request group) this request is derived from
+	NotBefore int64  `json:"nbf"`      // time stamp before which request should not be transferred
+	Deadline  int64  `json:"deadline"` // time stamp after which request expires if it is not transferred
+
+	Progress *GroupProgress `json:"progress,omitempty"` // aggregate progress of request group, it is provided by list of requests
+
+	newLfns []string        // LFNs of new replicas the transfer created at destination
+	ctx     context.Context // context of the transfer, it is cancelled when request is cancelled
 }
 
 // Job represents the job to be run
 type Job struct {
 	TransferRequest TransferRequest `json:"request"` // TransferRequest
 	Action          string          `json:"action"`  // Action to apply to TransferRequest, e.g. delete or transfer
+	Comment         string          `json:"comment"` // Comment of the action, e.g. reason of approval or rejection
+
+	since time.Time // time the job entered the queue, it is kept when job is put back
 }
 
 // Worker represents the worker that executes the job
 type Worker struct {
-	Id         int
-	JobPool    chan chan Job
-	JobChannel chan Job
-	quit       chan bool
+	Id    int
+	Queue *JobQueue // queue the worker takes jobs from
+	quit  chan bool
 }
 
 // Dispatcher implementation
 type Dispatcher struct {
-	// A pool of workers channels that are registered with the dispatcher
-	JobPool    chan chan Job
 	MaxWorkers int
-	BufferSize int
+
+	workers []Worker       // workers of the dispatcher
+	running sync.WaitGroup // running workers
 }
 
 // AgentMetrics defines various metrics about the agent work
 var AgentMetrics Metrics
 
-// StorageQueue is a buffered channel that we can send work requests on.
-var StorageQueue chan Job
+// StorageQueue is a queue of jobs which store incoming requests
+var StorageQueue *JobQueue
 
 // RequestQueue is a queue to sort the requests according to priority.
 var RequestQueue PriorityQueue
 
-// TransferQueue is an instance of dispatcher to handle the transfer process
-var TransferQueue chan Job
+// RequestQueueLock guards RequestQueue
+var RequestQueueLock sync.Mutex
+
+// TransferQueue is a queue of jobs which handle the transfer process
+var TransferQueue *JobQueue
 
 // TransferType decides which pull or push based model is used
 var TransferType string
@@ -121,15 +140,22 @@ func (m *Metrics) ToDict() map[string]int64 {
 
 // String method return string representation of transfer request
 func (t *TransferRequest) String() string {
-	return fmt.Sprintf("<TransferRequest id=%s priority=%d status=%s ts=%d lfn=%s block=%s dataset=%s srcUrl=%s srcAlias=%s dstUrl=%s dstAlias=%s regUrl=%s regAlias=%s delay=%d>", t.Id, t.Priority, t.Status, t.TimeStamp, t.Lfn, t.Block, t.Dataset, t.SrcUrl, t.SrcAlias, t.DstUrl, t.DstAlias, t.RegUrl, t.RegAlias, t.Delay)
+	return fmt.Sprintf("<TransferRequest id=%s priority=%d status=%s ts=%d lfn=%s block=%s dataset=%s srcUrl=%s srcAlias=%s dstUrl=%s dstAlias=%s regUrl=%s regAlias=%s delay=%d route=%v relays=%v user=%s bytes=%d parent=%s nbf=%d deadline=%d>", t.Id, t.Priority, t.Status, t.TimeStamp, t.Lfn, t.Block, t.Dataset, t.SrcUrl, t.SrcAlias, t.DstUrl, t.DstAlias, t.RegUrl, t.RegAlias, t.Delay, t.Route, t.Relays, t.User, t.Bytes, t.Parent, t.NotBefore, t.Deadline)
 }
 
 // Clone provides copy of transfer request
 func (t *TransferRequest) Clone() TransferRequest {
-	tr := TransferRequest{TimeStamp: t.TimeStamp, Lfn: t.Lfn, Block: t.Block, Dataset: t.Dataset, SrcUrl: t.SrcUrl, SrcAlias: t.SrcAlias, DstUrl: t.DstUrl, DstAlias: t.DstAlias, RegUrl: t.RegUrl, RegAlias: t.RegAlias, Delay: t.Delay, Id: t.Id, Priority: t.Priority, Status: t.Status}
+	tr := TransferRequest{TimeStamp: t.TimeStamp, Lfn: t.Lfn, Block: t.Block, Dataset: t.Dataset, SrcUrl: t.SrcUrl, SrcAlias: t.SrcAlias, DstUrl: t.DstUrl, DstAlias: t.DstAlias, RegUrl: t.RegUrl, RegAlias: t.RegAlias, Delay: t.Delay, Id: t.Id, Priority: t.Priority, Status: t.Status, User: t.User, Bytes: t.Bytes, Parent: t.Parent, NotBefore: t.NotBefore, Deadline: t.Deadline}
+	tr.Route = append([]Hop{}, t.Route...)
+	tr.Relays = append([]Hop{}, t.Relays...)
 	return tr
 }
 
+// Expired checks if deadline of transfer request is passed
+func (t *TransferRequest) Expired() bool {
+	return t.Deadline > 0 && time.Now().Unix() > t.Deadline
+}
+
 // UUID generates unique id for transfer request
 func (t *TransferRequest) UUID() string {
 	text := fmt.Sprintf("%s-%s-%s-%d", t.Lfn, t.Block, t.Dataset, time.Now().UnixNano())
@@ -140,9 +166,7 @@ func (t *TransferRequest) UUID() string {
 
 // RunPush method perform a job on transfer request. It will use push model
 func (t *TransferRequest) RunPush() error {
-	interval := time.Duration(t.Delay) * time.Second
 	request := Decorate(DefaultProcessor,
-		Pause(interval), // will pause a given request for a given interval
 		PushTransfer(),
 	)
 	return request.Process(t)
@@ -150,9 +174,7 @@ func (t *TransferRequest) RunPush() error {
 
 // RunPull method perform a job on transfer request. It will use pull model
 func (t *TransferRequest) RunPull() error {
-	interval := time.Duration(t.Delay) * time.Second
 	request := Decorate(DefaultProcessor,
-		Pause(interval), // will pause a given request for a given interval
 		PullTransfer(),
 	)
 	return request.Process(t)
@@ -160,19 +182,23 @@ func (t *TransferRequest) RunPull() error {
 
 // Delete performs deletion of transfer request
 func (t *TransferRequest) Delete() error {
-	interval := time.Duration(t.Delay) * time.Second
 	request := Decorate(DefaultProcessor,
-		Pause(interval), // will pause a given request for a given interval
 		Delete(),
 	)
 	return request.Process(t)
 }
 
+// Cleanup removes temporary replica of relayed transfer request
+func (t *TransferRequest) Cleanup() error {
+	request := Decorate(DefaultProcessor,
+		Cleanup(),
+	)
+	return request.Process(t)
+}
+
 // Store method stores a job in heap and db
 func (t *TransferRequest) Store() error {
-	interval := time.Duration(t.Delay) * time.Second
 	request := Decorate(DefaultProcessor,
-		Pause(interval), // will pause a given request for a given interval
 		Store(),
 	)
 	return request.Process(t)
@@ -217,6 +243,8 @@ func (j *Job) RequestFails() {
 		// update main agent
 		j.UpdateRequest("deleted")
 	case "transfer":
+		// transfer is abandoned, remove temporary replicas
+		j.CleanupRelays()
 		// update main agent
 		j.UpdateRequest("error")
 	}
@@ -231,99 +259,158 @@ func (j *Job) RequestSuccess() {
 		// update main agent
 		j.UpdateRequest("deleted")
 	case "transfer":
+		if len(j.TransferRequest.Route) > 0 {
+			// data reached intermediate agent, send it further
+			err := j.NextHop()
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Error":   err,
+					"Request": j.TransferRequest.String(),
+				}).Error("Unable to submit next hop of the request")
+				j.UpdateRequest("error")
+			}
+			return
+		}
+		// data reached final destination, remove temporary replicas
+		j.CleanupRelays()
 		// update main agent
 		j.UpdateRequest("finished")
 	}
 }
 
 // NewWorker return a new instance of the Worker type
-func NewWorker(wid int, bufferSize int, jobPool chan chan Job) Worker {
+func NewWorker(wid int, queue *JobQueue) Worker {
 	return Worker{
-		Id:         wid,
-		JobPool:    jobPool,
-		JobChannel: make(chan Job, bufferSize),
-		quit:       make(chan bool)}
+		Id:    wid,
+		Queue: queue,
+		quit:  make(chan bool)}
 }
 
-// Start method starts the run loop for the worker, listening for a quit channel in
-// case we need to stop it
-func (w Worker) Start() {
+// Start method starts the run loop for the worker, the worker stops when
+// given context is done or when we stop it
+func (w Worker) Start(ctx context.Context, wg *sync.WaitGroup) {
 	var err error
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-w.quit:
+			// we have received a signal to stop
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	// register the current worker into the worker queue.
-	w.JobPool <- w.JobChannel
-
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
+		defer cancel()
 		for {
-			select {
-			case job := <-w.JobChannel:
-				// Add info to agents metrics
-				AgentMetrics.In.Inc(1)
-				// we have received a work request.
-				switch job.Action {
-				case "store":
-					err = job.TransferRequest.Store()
-				case "delete":
-					err = job.TransferRequest.Delete()
-				case "transfer":
-					if TransferType == "push" {
-						err = job.TransferRequest.RunPush()
-					} else {
-						err = job.TransferRequest.RunPull()
-					}
-				default:
+			// wait for a ready job, the queue is done when agent is shutting down
+			job, ok := w.Queue.Next(ctx)
+			if !ok {
+				return
+			}
+			// Add info to agents metrics
+			AgentMetrics.In.Inc(1)
+			// we have received a work request.
+			switch job.Action {
+			case "store":
+				err = job.TransferRequest.Store()
+			case "delete":
+				err = job.TransferRequest.Delete()
+			case "cleanup":
+				err = job.TransferRequest.Cleanup()
+			case "transfer":
+				if AgentTransfers.Cancelled(job.TransferRequest) {
 					logs.WithFields(logs.Fields{
-						"Action": job.Action,
-					}).Error("Can't perform requested action")
+						"Request": job.TransferRequest.String(),
+					}).Info("Discard job of cancelled request")
+					job.CleanupRelays()
+					AgentMetrics.In.Dec(1)
+					continue
 				}
-
-				if err != nil || job.TransferRequest.Status == "error" || job.TransferRequest.Status == "processing" {
-					// decide if we'll drop the request or put it on hold by increasing its delay
-					// and put back to job channel
-					if job.TransferRequest.Delay > TransferDelayThreshold {
+				if job.TransferRequest.Expired() {
+					logs.WithFields(logs.Fields{
+						"Request": job.TransferRequest.String(),
+					}).Warn("Deadline of the request is passed")
+					job.CleanupRelays()
+					job.UpdateRequest("expired")
+					AgentMetrics.Failed.Inc(1)
+					AgentMetrics.In.Dec(1)
+					continue
+				}
+				if !AgentWindows.Open(time.Now()) {
+					// transfer window is closed while job waited for a worker, hold it until window opens
+					w.Queue.Requeue(job)
+					AgentMetrics.In.Dec(1)
+					continue
+				}
+				tctx, done := AgentTransfers.Start(job.TransferRequest)
+				job.TransferRequest.ctx = tctx
+				if TransferType == "push" {
+					err = job.TransferRequest.RunPush()
+				} else {
+					err = job.TransferRequest.RunPull()
+				}
+				cancelled := job.TransferRequest.Cancelled()
+				job.TransferRequest.ctx = nil
+				done()
+				if cancelled {
+					if AgentTransfers.Cancelled(job.TransferRequest) {
 						logs.WithFields(logs.Fields{
-							"Action":  job.Action,
 							"Request": job.TransferRequest.String(),
-						}).Error("Exceed number of iteration, discard request")
-						job.RequestFails()
-						AgentMetrics.Failed.Inc(1)
-						w.JobPool <- w.JobChannel
-					} else if job.TransferRequest.Delay > 0 {
-						job.TransferRequest.Delay *= 2
-						logs.WithFields(logs.Fields{
 							"Error":   err,
-							"Action":  job.Action,
-							"Request": job.TransferRequest.String(),
-						}).Warn("put on hold")
-						w.JobChannel <- job
+						}).Warn("Transfer is cancelled")
+						job.CleanupRelays()
+					} else {
+						// transfer is interrupted by agent shutdown, we'll resume it after restart
+						unfinished.add(job)
+					}
+					AgentMetrics.In.Dec(1)
+					continue
+				}
+			default:
+				logs.WithFields(logs.Fields{
+					"Action": job.Action,
+				}).Error("Can't perform requested action")
+			}
+
+			if err != nil || job.TransferRequest.Status == "error" || job.TransferRequest.Status == "processing" {
+				// decide if we'll drop the request or put it on hold by increasing its delay
+				// and put back to the queue
+				if job.TransferRequest.Delay > TransferDelayThreshold {
+					logs.WithFields(logs.Fields{
+						"Action":  job.Action,
+						"Request": job.TransferRequest.String(),
+					}).Error("Exceed number of iteration, discard request")
+					job.RequestFails()
+					AgentMetrics.Failed.Inc(1)
+				} else {
+					if job.TransferRequest.Delay > 0 {
+						job.TransferRequest.Delay *= 2
 					} else {
 						job.TransferRequest.Delay = 60
-						logs.WithFields(logs.Fields{
-							"Error":   err,
-							"Action":  job.Action,
-							"Request": job.TransferRequest.String(),
-						}).Warn("put on hold")
-						w.JobChannel <- job
 					}
-				} else if job.TransferRequest.Status != "" {
-					// we got record which still in progress, e.g. agent stager is staging data
-					// let's delay its processing and put it back to the job queue
-					job.TransferRequest.Delay = 60
 					logs.WithFields(logs.Fields{
+						"Error":   err,
 						"Action":  job.Action,
 						"Request": job.TransferRequest.String(),
 					}).Warn("put on hold")
-					w.JobChannel <- job
-				} else {
-					job.RequestSuccess()
-					// decrement transfer counter
-					AgentMetrics.In.Dec(1)
-					w.JobPool <- w.JobChannel
+					w.Queue.Requeue(job)
 				}
-
-			case <-w.quit:
-				// we have received a signal to stop
-				return
+			} else if job.TransferRequest.Status != "" {
+				// we got record which still in progress, e.g. agent stager is staging data
+				// let's delay its processing and put it back to the queue
+				job.TransferRequest.Delay = 60
+				logs.WithFields(logs.Fields{
+					"Action":  job.Action,
+					"Request": job.TransferRequest.String(),
+				}).Warn("put on hold")
+				w.Queue.Requeue(job)
+			} else {
+				job.RequestSuccess()
+				// decrement transfer counter
+				AgentMetrics.In.Dec(1)
 			}
 		}
 	}()
@@ -337,22 +424,13 @@ func (w Worker) Stop() {
 }
 
 // NewDispatcher returns new instance of Dispatcher type
-func NewDispatcher(maxWorkers int, bufferSize int) *Dispatcher {
-	// define pool of workers
-	pool := make(chan chan Job, maxWorkers)
-	return &Dispatcher{JobPool: pool, MaxWorkers: maxWorkers, BufferSize: bufferSize}
-}
-
-// NewStager returns new instance of Dispatcher type
-func NewStager(pool string, catalog Catalog) *FileSystemStager {
-	if pool == "" {
-		pool = "/tmp/transfer2go" // default pool area resides in /tmp
-	}
-	return &FileSystemStager{Pool: pool, Catalog: catalog}
+func NewDispatcher(maxWorkers int) *Dispatcher {
+	return &Dispatcher{MaxWorkers: maxWorkers}
 }
 
-// InitQueue initializes RequestQueue, transferQueue and StorageQueue
-func InitQueue(transferQueueSize int, storageQueueSize int, mfile string, minterval int64, monitorTime int64, router bool) {
+// InitQueue initializes RequestQueue, transferQueue and StorageQueue, the
+// background processes of the queues run until given context is done
+func InitQueue(ctx context.Context, transferQueueSize int, storageQueueSize int, mfile string, minterval int64, monitorTime int64, router bool) {
 	// register metrics
 	f, e := os.OpenFile(mfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if e != nil {
@@ -379,8 +457,15 @@ func InitQueue(transferQueueSize int, storageQueueSize int, mfile string, minter
 
 	// Run background process to calculate machine usage
 	go func() {
-		for range time.Tick(time.Duration(minterval) * time.Second) {
-			AgentMetrics.GetCurrentStats()
+		ticker := time.NewTicker(time.Duration(minterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				AgentMetrics.GetCurrentStats()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -390,7 +475,8 @@ func InitQueue(transferQueueSize int, storageQueueSize int, mfile string, minter
 	}()
 
 	// initialize Storage and Request queues
-	StorageQueue = make(chan Job, storageQueueSize)
+	StorageQueue = NewJobQueue(storageQueueSize)
+	RequestQueueLock.Lock()
 	RequestQueue = make(PriorityQueue, 0) // Create a priority queue
 
 	// Load pending requests from DB
@@ -400,72 +486,43 @@ func InitQueue(transferQueueSize int, storageQueueSize int, mfile string, minter
 	for i := 0; i < len(requests); i++ {
 		heap.Push(&RequestQueue, &Item{Value: requests[i], priority: requests[i].Priority})
 	}
+	RequestQueueLock.Unlock()
 	if router == true {
 		RouterModel = router
 		AgentRouter.InitialTrain()
 	}
 	logs.Println("Requests restored from db")
-	TransferQueue = make(chan Job, transferQueueSize)
-}
+	TransferQueue = NewJobQueue(transferQueueSize)
 
-// StorageRunner function starts the worker and dispatch it as go-routine
-func (d *Dispatcher) StorageRunner() {
-	// starting n number of workers
-	for i := 0; i < d.MaxWorkers; i++ {
-		worker := NewWorker(i, d.BufferSize, d.JobPool)
-		worker.Start()
-	}
+	// restore jobs which were not processed before agent shutdown
+	restoreJobs()
 
-	go d.dispatchToStorage()
+	// expire pending requests which missed their deadline
+	go expireRequests(ctx, time.Minute)
 }
 
-func (d *Dispatcher) dispatchToStorage() {
-	for {
-		select {
-		case job := <-StorageQueue:
-			// a job request has been received
-			go func(job Job) {
-				// try to obtain a worker job channel that is available.
-				// this will block until a worker is idle
-				jobChannel := <-d.JobPool
-
-				// dispatch the job to the worker job channel
-				jobChannel <- job
-			}(job)
-		default:
-			time.Sleep(time.Duration(10) * time.Millisecond) // wait for a job
-		}
-	}
+// StorageRunner function starts the workers which process StorageQueue
+func (d *Dispatcher) StorageRunner(ctx context.Context) {
+	d.startWorkers(ctx, StorageQueue)
+}
+
+// TransferRunner function starts the workers which process TransferQueue
+func (d *Dispatcher) TransferRunner(ctx context.Context) {
+	d.startWorkers(ctx, TransferQueue)
 }
 
-// TransferRunner function starts the worker and dispatch it as go-routine
-func (d *Dispatcher) TransferRunner() {
-	// starting n number of workers
+// helper function to start n number of workers on given queue
+func (d *Dispatcher) startWorkers(ctx context.Context, queue *JobQueue) {
 	for i := 0; i < d.MaxWorkers; i++ {
-		worker := NewWorker(i, d.BufferSize, d.JobPool)
-		worker.Start()
+		worker := NewWorker(i, queue)
+		worker.Start(ctx, &d.running)
+		d.workers = append(d.workers, worker)
 	}
-
-	go d.dispatchToTransfer()
 }
 
-func (d *Dispatcher) dispatchToTransfer() {
-	for {
-		select {
-		case job := <-TransferQueue:
-			// a job request has been received
-			go func(job Job) {
-				// try to obtain a worker job channel that is available.
-				// this will block until a worker is idle
-				jobChannel := <-d.JobPool
-
-				// dispatch the job to the worker job channel
-				jobChannel <- job
-			}(job)
-		default:
-			time.Sleep(time.Duration(10) * time.Millisecond) // wait for a job
-		}
-	}
+// Wait waits until workers of the dispatcher finish their jobs
+func (d *Dispatcher) Wait() {
+	d.running.Wait()
 }
 
 // GetCurrentStats function to get current system usage
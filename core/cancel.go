@@ -0,0 +1,170 @@
+package core
+
+// transfer2go cancellation of in-flight transfers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// cancelledTTL defines how long we remember cancelled requests, jobs of these
+// requests which are still queued or on hold are discarded
+const cancelledTTL = 24 * time.Hour
+
+// transfer represents running transfer of the request
+type transfer struct {
+	id     string             // request id
+	parent string             // parent request id
+	cancel context.CancelFunc // cancels the transfer
+}
+
+// TransferRegistry keeps track of running transfers and cancelled requests, it is safe for concurrent use
+type TransferRegistry struct {
+	sync.Mutex
+	seq       int64              // sequence number of the last started transfer
+	running   map[int64]transfer // running transfers
+	cancelled map[string]int64   // request id and time stamp of its cancellation
+}
+
+// AgentTransfers holds transfers of this agent
+var AgentTransfers = NewTransferRegistry()
+
+// NewTransferRegistry returns new instance of TransferRegistry type
+func NewTransferRegistry() *TransferRegistry {
+	return &TransferRegistry{running: make(map[int64]transfer), cancelled: make(map[string]int64)}
+}
+
+// Start registers transfer of given request and returns its context along with
+// function which should be called when transfer is over
+func (r *TransferRegistry) Start(t TransferRequest) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Lock()
+	defer r.Unlock()
+	if r.cancelled[t.Id] > 0 || (t.Parent != "" && r.cancelled[t.Parent] > 0) {
+		cancel()
+	}
+	r.seq++
+	key := r.seq
+	r.running[key] = transfer{id: t.Id, parent: t.Parent, cancel: cancel}
+	done := func() {
+		r.Lock()
+		delete(r.running, key)
+		r.Unlock()
+		cancel()
+	}
+	return ctx, done
+}
+
+// Cancel cancels running transfers of given request or of requests derived
+// from it, and remembers the request to discard its jobs which are not yet running
+func (r *TransferRegistry) Cancel(rid string) int {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now().Unix()
+	for id, ts := range r.cancelled {
+		if now-ts > int64(cancelledTTL.Seconds()) {
+			delete(r.cancelled, id)
+		}
+	}
+	r.cancelled[rid] = now
+	count := 0
+	for _, tr := range r.running {
+		if tr.id == rid || tr.parent == rid {
+			tr.cancel()
+			count++
+		}
+	}
+	return count
+}
+
+// Abort cancels all running transfers, e.g. when agent is shutting down, the
+// requests of these transfers are not considered cancelled
+func (r *TransferRegistry) Abort() int {
+	r.Lock()
+	defer r.Unlock()
+	for _, tr := range r.running {
+		tr.cancel()
+	}
+	return len(r.running)
+}
+
+// Cancelled checks if given request or its parent is cancelled
+func (r *TransferRegistry) Cancelled(t TransferRequest) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.cancelled[t.Id] > 0 || (t.Parent != "" && r.cancelled[t.Parent] > 0)
+}
+
+// Running returns number of running transfers
+func (r *TransferRegistry) Running() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.running)
+}
+
+// Context returns context of the transfer request
+func (t *TransferRequest) Context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// Cancelled checks if transfer of the request is cancelled
+func (t *TransferRequest) Cancelled() bool {
+	return t.Context().Err() == context.Canceled
+}
+
+// helper function to collect agents which may hold jobs of given requests
+func holders(requests []TransferRequest) []string {
+	var urls []string
+	add := func(aurl string) {
+		if aurl != "" && !utils.InList(aurl, urls) {
+			urls = append(urls, aurl)
+		}
+	}
+	for _, t := range requests {
+		add(t.SrcUrl)
+		add(t.DstUrl)
+		for _, hop := range t.Route {
+			add(hop.Url)
+		}
+		for _, hop := range t.Relays {
+			add(hop.Url)
+		}
+	}
+	return urls
+}
+
+// AbortTransfers asks agents which hold jobs of given request and its derived
+// requests to abort them
+func AbortTransfers(t TransferRequest, children []TransferRequest) {
+	job := Job{TransferRequest: TransferRequest{Id: t.Id}, Action: "abort"}
+	notifyHolders(job, append(children, t))
+}
+
+// helper function to send given job to agents which hold jobs of given requests
+func notifyHolders(job Job, requests []TransferRequest) {
+	data, err := json.Marshal([]Job{job})
+	if err != nil {
+		return
+	}
+	for _, aurl := range holders(requests) {
+		resp := utils.FetchResponse(fmt.Sprintf("%s/action", aurl), data) // POST request
+		if resp.Error != nil || resp.StatusCode != 200 {
+			logs.WithFields(logs.Fields{
+				"Request": job.TransferRequest.Id,
+				"Action":  job.Action,
+				"Agent":   aurl,
+				"Status":  resp.StatusCode,
+				"Error":   resp.Error,
+			}).Warn("Unable to send action to agent")
+		}
+	}
+}
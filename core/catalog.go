@@ -5,6 +5,7 @@ package core
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os/exec"
@@ -99,6 +100,48 @@ func getSQL(key string) string {
 	return stm.(string)
 }
 
+// requestColumns lists columns added to REQUESTS table after its initial
+// schema, existing rows get default values of the columns
+var requestColumns = [][2]string{
+	{"user", "TEXT DEFAULT ''"},
+	{"bytes", "INTEGER DEFAULT 0"},
+	{"ts", "INTEGER DEFAULT 0"},
+	{"parent", "TEXT DEFAULT ''"},
+	{"notbefore", "INTEGER DEFAULT 0"},
+	{"deadline", "INTEGER DEFAULT 0"},
+}
+
+// UpgradeSchema brings catalog created with older schema up to date, it
+// creates missing tables and adds missing columns of REQUESTS table
+func UpgradeSchema() error {
+	_, err := DB.Exec(getSQL("upgrade_tables"))
+	if err != nil {
+		return err
+	}
+	rows, err := DB.Query("SELECT * FROM REQUESTS WHERE 1=0")
+	if err != nil {
+		return err
+	}
+	cols, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, c := range requestColumns {
+		if utils.InList(c[0], cols) {
+			continue
+		}
+		_, err = DB.Exec(fmt.Sprintf("ALTER TABLE REQUESTS ADD COLUMN %s %s", c[0], c[1]))
+		if err != nil {
+			return err
+		}
+		logs.WithFields(logs.Fields{
+			"Column": c[0],
+		}).Info("Added column to REQUESTS table")
+	}
+	return nil
+}
+
 // helper function to assign placeholder for SQL WHERE clause, it depends on database type
 func placeholder(pholder string) string {
 	if DBTYPE == "ora" || DBTYPE == "oci8" {
@@ -203,6 +246,25 @@ func (c *Catalog) Add(entry CatalogEntry) error {
 	return nil
 }
 
+// Delete method removes entry with given lfn from a catalog
+func (c *Catalog) Delete(lfn string) error {
+	stm := getSQL("delete_files")
+	_, err := DB.Exec(stm, lfn)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Lfn":   lfn,
+			"Error": err,
+		}).Error("Unable to delete catalog entry")
+		return err
+	}
+	if utils.VERBOSE > 0 {
+		logs.WithFields(logs.Fields{
+			"Lfn": lfn,
+		}).Println("Deleted from Catalog")
+	}
+	return nil
+}
+
 // Files returns list of files for specified conditions
 func (c *Catalog) Files(dataset, block, lfn string) []string {
 	var files []string
@@ -414,10 +476,10 @@ func (c *Catalog) GetTransfers(time0, time1 string) ([]TransferData, error) {
 	return out, nil
 }
 
-// InsertRequest inserts new request
-func (c *Catalog) InsertRequest(r TransferRequest) error {
+// InsertRequest inserts new request with given status, status of the request itself is ignored
+func (c *Catalog) InsertRequest(r TransferRequest, status string) error {
 	stm := getSQL("insert_request")
-	_, e := DB.Exec(stm, r.Id, r.Lfn, r.Block, r.Dataset, r.SrcUrl, r.SrcAlias, r.DstUrl, r.DstAlias, r.RegUrl, r.RegAlias, "pending", r.Priority)
+	_, e := DB.Exec(stm, r.Id, r.Lfn, r.Block, r.Dataset, r.SrcUrl, r.SrcAlias, r.DstUrl, r.DstAlias, r.RegUrl, r.RegAlias, status, r.Priority, r.User, r.Bytes, r.TimeStamp, r.Parent, r.NotBefore, r.Deadline)
 	logs.WithFields(logs.Fields{
 		"Request": r,
 	}).Info("Catalog: InsertRequest")
@@ -458,7 +520,7 @@ func (c *Catalog) RetrieveRequest(r *TransferRequest) error {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		if err := rows.Scan(&r.Lfn, &r.Block, &r.Dataset, &r.SrcUrl, &r.SrcAlias, &r.DstUrl, &r.DstAlias, &r.RegUrl, &r.RegAlias, &r.Priority); err != nil {
+		if err := rows.Scan(&r.Lfn, &r.Block, &r.Dataset, &r.SrcUrl, &r.SrcAlias, &r.DstUrl, &r.DstAlias, &r.RegUrl, &r.RegAlias, &r.Priority, &r.User, &r.Bytes, &r.Status, &r.Parent, &r.NotBefore, &r.Deadline); err != nil {
 			r.Status = err.Error()
 			return err
 		}
@@ -510,6 +572,18 @@ func (c *Catalog) ListRequest(query string) ([]TransferRequest, error) {
 	case "processing":
 		stm := getSQL("request_by_status") // Error occurred while transferring data
 		rows, err = DB.Query(stm, query)
+	case "rejected":
+		stm := getSQL("request_by_status") // Request exceeded quota or is rejected by approver
+		rows, err = DB.Query(stm, query)
+	case "transferring":
+		stm := getSQL("request_by_status") // Request is sent to agents
+		rows, err = DB.Query(stm, query)
+	case "cancelled":
+		stm := getSQL("request_by_status") // Request is cancelled by the user
+		rows, err = DB.Query(stm, query)
+	case "expired":
+		stm := getSQL("request_by_status") // Request is not transferred before its deadline
+		rows, err = DB.Query(stm, query)
 	default:
 		return nil, errors.New("Requested request type could not find")
 	}
@@ -517,31 +591,72 @@ func (c *Catalog) ListRequest(query string) ([]TransferRequest, error) {
 	if err != nil {
 		return nil, err
 	}
-	cols, err := rows.Columns()
 	defer rows.Close()
+	return scanRequests(rows)
+}
+
+// Children returns requests derived from given parent request
+func (c *Catalog) Children(parent string) ([]TransferRequest, error) {
+	stm := getSQL("requests_by_parent")
+	rows, err := DB.Query(stm, parent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRequests(rows)
+}
+
+// helper function to scan rows of REQUESTS table
+func scanRequests(rows *sql.Rows) ([]TransferRequest, error) {
+	cols, err := rows.Columns()
 	if err != nil {
 		return nil, err
 	}
 
 	pointers := make([]interface{}, len(cols))
-	con := make([]string, len(cols)) // A pointer to Columns of db
+	con := make([]sql.NullString, len(cols)) // A pointer to Columns of db
 	var requests []TransferRequest
 
 	for i := range pointers {
 		pointers[i] = &con[i]
 	}
 
-	// Sqlite columns => 0:id 1:rid 2:file 3:block 4:dataset 5:srcurl 6:srcalias 7:dsturl 8:dstalias 9:regurl 10:regalias 11:status 12:priority
+	// Sqlite columns => 0:id 1:rid 2:file 3:block 4:dataset 5:srcurl 6:srcalias 7:dsturl 8:dstalias 9:regurl 10:regalias 11:status 12:priority 13:user 14:bytes 15:ts 16:parent 17:notbefore 18:deadline
 	for rows.Next() {
 		rows.Scan(pointers...)
-		priority, err := strconv.Atoi(con[12])
+		priority, err := strconv.Atoi(con[12].String)
 		if err != nil {
 			return nil, err
 		}
-		r := TransferRequest{SrcUrl: con[5], SrcAlias: con[6], DstUrl: con[7], DstAlias: con[8], RegUrl: con[9], RegAlias: con[10], Lfn: con[2], Block: con[3], Dataset: con[4], Id: con[1], Priority: priority, Status: con[11]}
+		bytes, _ := strconv.ParseInt(con[14].String, 10, 64)
+		ts, _ := strconv.ParseInt(con[15].String, 10, 64)
+		nbf, _ := strconv.ParseInt(con[17].String, 10, 64)
+		deadline, _ := strconv.ParseInt(con[18].String, 10, 64)
+		r := TransferRequest{SrcUrl: con[5].String, SrcAlias: con[6].String, DstUrl: con[7].String, DstAlias: con[8].String, RegUrl: con[9].String, RegAlias: con[10].String, Lfn: con[2].String, Block: con[3].String, Dataset: con[4].String, Id: con[1].String, Priority: priority, Status: con[11].String, User: con[13].String, Bytes: bytes, TimeStamp: ts, Parent: con[16].String, NotBefore: nbf, Deadline: deadline}
 		requests = append(requests, r)
 	}
-	return requests, err
+	return requests, rows.Err()
+}
+
+// GroupProgress returns aggregate progress of requests derived from given parent request
+func (c *Catalog) GroupProgress(parent string) (GroupProgress, error) {
+	var p GroupProgress
+	stm := getSQL("group_progress")
+	err := DB.QueryRow(stm, parent).Scan(&p.Total, &p.Done, &p.Failed, &p.Cancelled, &p.Expired, &p.Bytes, &p.BytesDone)
+	return p, err
+}
+
+// CancelChildren cancels requests derived from given parent request which are not yet completed
+func (c *Catalog) CancelChildren(parent string) error {
+	stm := getSQL("cancel_children")
+	return c.Exec(stm, "cancelled", parent)
+}
+
+// UpdatePriority changes priority of given request and its derived requests
+func (c *Catalog) UpdatePriority(rid string, priority int) error {
+	stm := getSQL("update_priority")
+	_, err := DB.Exec(stm, priority, rid, rid)
+	return err
 }
 
 // InsertTransfers inserts new row to TRANSFERS table
@@ -549,3 +664,156 @@ func (c *Catalog) InsertTransfers(time int64, cpuUsage float64, memUsage float64
 	stm := getSQL("insert_transfers")
 	DB.Exec(stm, time, cpuUsage, memUsage, throughput)
 }
+
+// PutAgent inserts or updates agent record in AGENTS table
+func (c *Catalog) PutAgent(rec AgentRecord) error {
+	stm := getSQL("insert_agent")
+	_, err := DB.Exec(stm, rec.Alias, rec.Url, rec.Protocol, rec.Backend, strings.Join(rec.Capabilities, ","), rec.Version, rec.LastSeen, rec.State)
+	return err
+}
+
+// DeleteAgent removes agent record from AGENTS table
+func (c *Catalog) DeleteAgent(alias string) error {
+	stm := getSQL("delete_agent")
+	_, err := DB.Exec(stm, alias)
+	return err
+}
+
+// Agents returns agent records from AGENTS table
+func (c *Catalog) Agents() ([]AgentRecord, error) {
+	stm := getSQL("all_agents")
+	rows, err := DB.Query(stm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []AgentRecord
+	for rows.Next() {
+		var rec AgentRecord
+		var caps string
+		err := rows.Scan(&rec.Alias, &rec.Url, &rec.Protocol, &rec.Backend, &caps, &rec.Version, &rec.LastSeen, &rec.State)
+		if err != nil {
+			return nil, err
+		}
+		if caps != "" {
+			rec.Capabilities = strings.Split(caps, ",")
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// InsertAudit inserts audit record into AUDIT table
+func (c *Catalog) InsertAudit(rec AuditRecord) error {
+	stm := getSQL("insert_audit")
+	_, err := DB.Exec(stm, rec.TimeStamp, rec.User, rec.Agent, rec.Endpoint, rec.Method, rec.Action, strings.Join(rec.Requests, ","), rec.Status, rec.Outcome)
+	return err
+}
+
+// Audit returns audit records since given time stamp, the records can be
+// filtered by user and action
+func (c *Catalog) Audit(since int64, user, action string) ([]AuditRecord, error) {
+	stm := getSQL("audit")
+	rows, err := DB.Query(stm, since, user, user, action, action)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []AuditRecord
+	for rows.Next() {
+		var rec AuditRecord
+		var ids string
+		err := rows.Scan(&rec.TimeStamp, &rec.User, &rec.Agent, &rec.Endpoint, &rec.Method, &rec.Action, &ids, &rec.Status, &rec.Outcome)
+		if err != nil {
+			return nil, err
+		}
+		if ids != "" {
+			rec.Requests = strings.Split(ids, ",")
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// QuotaUsage returns quota usage of given user (kind=user) or destination site (kind=site)
+func (c *Catalog) QuotaUsage(kind, name string) (QuotaUsage, error) {
+	var usage QuotaUsage
+	stm := getSQL(fmt.Sprintf("quota_%s", kind))
+	since := time.Now().Add(-24 * time.Hour).Unix()
+	err := DB.QueryRow(stm, since, name).Scan(&usage.Pending, &usage.Bytes, &usage.BytesPerDay)
+	return usage, err
+}
+
+// InsertApproval stores approval decision of the request
+func (c *Catalog) InsertApproval(a Approval) error {
+	stm := getSQL("insert_approval")
+	_, err := DB.Exec(stm, a.Request, a.User, strings.Join(a.Roles, ","), a.Decision, a.Comment, a.TimeStamp)
+	return err
+}
+
+// Approvals returns approval decisions of given request
+func (c *Catalog) Approvals(rid string) ([]Approval, error) {
+	stm := getSQL("approvals")
+	rows, err := DB.Query(stm, rid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Approval
+	for rows.Next() {
+		var a Approval
+		var roles string
+		err := rows.Scan(&a.Request, &a.User, &roles, &a.Decision, &a.Comment, &a.TimeStamp)
+		if err != nil {
+			return nil, err
+		}
+		if roles != "" {
+			a.Roles = strings.Split(roles, ",")
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// InsertJob persists job which was not processed before agent shutdown
+func (c *Catalog) InsertJob(job Job) error {
+	data, err := json.Marshal(job.TransferRequest)
+	if err != nil {
+		return err
+	}
+	stm := getSQL("insert_job")
+	_, err = DB.Exec(stm, job.Action, string(data), time.Now().Unix())
+	return err
+}
+
+// Jobs returns persisted jobs
+func (c *Catalog) Jobs() ([]Job, error) {
+	stm := getSQL("all_jobs")
+	rows, err := DB.Query(stm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Job
+	for rows.Next() {
+		var job Job
+		var data string
+		err := rows.Scan(&job.Action, &data)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(data), &job.TransferRequest)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, job)
+	}
+	return out, nil
+}
+
+// DeleteJobs removes persisted jobs
+func (c *Catalog) DeleteJobs() error {
+	stm := getSQL("delete_jobs")
+	_, err := DB.Exec(stm)
+	return err
+}
@@ -0,0 +1,74 @@
+package core
+
+// transfer2go fair-share of agent workers across destinations and users
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Shares represents weights of destinations and users. Jobs of a destination
+// and a user get share of workers proportional to product of their weights,
+// the "*" key defines default weight, otherwise the weight is 1.
+type Shares struct {
+	Destinations map[string]float64 `json:"destinations"` // destination alias and its weight
+	Users        map[string]float64 `json:"users"`        // user name and its weight
+}
+
+// ShareWeights holds fair-share weights, it is safe for concurrent use
+type ShareWeights struct {
+	sync.RWMutex
+	shares Shares
+}
+
+// AgentShares holds fair-share weights of the agent
+var AgentShares = &ShareWeights{}
+
+// helper function to find weight of given name
+func weight(weights map[string]float64, name string) float64 {
+	if w, ok := weights[name]; ok {
+		return w
+	}
+	if w, ok := weights["*"]; ok {
+		return w
+	}
+	return 1
+}
+
+// Validate checks that all weights are positive
+func (s Shares) Validate() error {
+	for _, weights := range []map[string]float64{s.Destinations, s.Users} {
+		for name, w := range weights {
+			if w <= 0 {
+				return fmt.Errorf("Weight of %s must be positive, got %v", name, w)
+			}
+		}
+	}
+	return nil
+}
+
+// Set replaces fair-share weights
+func (s *ShareWeights) Set(shares Shares) error {
+	err := shares.Validate()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.shares = shares
+	return nil
+}
+
+// Get returns fair-share weights
+func (s *ShareWeights) Get() Shares {
+	s.RLock()
+	defer s.RUnlock()
+	return s.shares
+}
+
+// Weight returns weight of jobs of given destination and user
+func (s *ShareWeights) Weight(dst, user string) float64 {
+	s.RLock()
+	defer s.RUnlock()
+	return weight(s.shares.Destinations, dst) * weight(s.shares.Users, user)
+}
@@ -0,0 +1,207 @@
+package core
+
+// transfer2go request groups, i.e. original request and requests derived from it
+
+import (
+	"errors"
+	"fmt"
+
+	logs "github.com/sirupsen/logrus"
+)
+
+// GroupProgress represents aggregate progress of requests derived from parent request
+type GroupProgress struct {
+	Total     int64 `json:"total"`     // total number of derived requests
+	Done      int64 `json:"done"`      // number of finished requests
+	Failed    int64 `json:"failed"`    // number of failed requests
+	Cancelled int64 `json:"cancelled"` // number of cancelled or deleted requests
+	Expired   int64 `json:"expired"`   // number of requests which missed their deadline
+	Bytes     int64 `json:"bytes"`     // total number of bytes
+	BytesDone int64 `json:"bytesDone"` // number of transferred bytes
+}
+
+// String provides string representation of group progress
+func (p *GroupProgress) String() string {
+	return fmt.Sprintf("<GroupProgress total=%d done=%d failed=%d cancelled=%d expired=%d bytes=%d/%d>", p.Total, p.Done, p.Failed, p.Cancelled, p.Expired, p.BytesDone, p.Bytes)
+}
+
+// Status returns status of parent request based on progress of its group,
+// empty status is returned for group without derived requests
+func (p *GroupProgress) Status() string {
+	if p.Total == 0 {
+		return ""
+	}
+	if p.Done+p.Failed+p.Cancelled+p.Expired < p.Total {
+		return "transferring"
+	}
+	if p.Failed > 0 {
+		return "error"
+	}
+	if p.Expired > 0 {
+		return "expired"
+	}
+	if p.Done == 0 {
+		return "cancelled"
+	}
+	return "finished"
+}
+
+// Dispatch sends approved request to agents, the request leaves the queue of
+// pending requests and becomes transferring
+func Dispatch(t *TransferRequest) error {
+	if t.Expired() {
+		RequestQueueLock.Lock()
+		RequestQueue.Delete(t.Id)
+		RequestQueueLock.Unlock()
+		err := TFC.UpdateRequest(t.Id, "expired")
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Request %s is expired", t.Id)
+	}
+	err := RedirectRequest(t)
+	if err != nil {
+		return err
+	}
+	RequestQueueLock.Lock()
+	RequestQueue.Delete(t.Id)
+	RequestQueueLock.Unlock()
+	return TFC.UpdateRequest(t.Id, "transferring")
+}
+
+// UpdateGroup updates status of parent request according to progress of its group
+func UpdateGroup(parent string) error {
+	progress, err := TFC.GroupProgress(parent)
+	if err != nil {
+		return err
+	}
+	status := progress.Status()
+	if status == "" {
+		return nil
+	}
+	logs.WithFields(logs.Fields{
+		"Parent":   parent,
+		"Progress": progress.String(),
+		"Status":   status,
+	}).Debug("Update request group")
+	return TFC.UpdateRequest(parent, status)
+}
+
+// helper function to check that given user owns given request, admin may act on any request
+func owner(t TransferRequest, u User) error {
+	if t.User == u.Name || AgentPolicy.Admin(u) {
+		return nil
+	}
+	return fmt.Errorf("User %s does not own request %s", u.Name, t.Id)
+}
+
+// CancelGroup cancels given request along with its derived requests which are
+// not yet completed, and asks agents to abort their transfers. Only owner of
+// the request or admin may cancel it.
+func CancelGroup(rid string, u User) error {
+	t := TransferRequest{Id: rid}
+	err := TFC.RetrieveRequest(&t)
+	if err != nil {
+		return err
+	}
+	if t.Status == "" {
+		return fmt.Errorf("Unknown request %s", rid)
+	}
+	err = owner(t, u)
+	if err != nil {
+		return err
+	}
+	children, err := TFC.Children(rid)
+	if err != nil {
+		return err
+	}
+	RequestQueueLock.Lock()
+	RequestQueue.Delete(rid)
+	RequestQueueLock.Unlock()
+	err = TFC.CancelChildren(rid)
+	if err != nil {
+		return err
+	}
+	err = TFC.UpdateRequest(rid, "cancelled")
+	if err != nil {
+		return err
+	}
+	if t.Status != "pending" {
+		// request is already dispatched to agents
+		go AbortTransfers(t, children)
+	}
+	return nil
+}
+
+// RetryGroup resubmits failed requests of given group. Request without derived
+// requests is dispatched again. Only owner of the request or admin may retry it.
+func RetryGroup(rid string, u User) error {
+	t := TransferRequest{Id: rid}
+	err := TFC.RetrieveRequest(&t)
+	if err != nil {
+		return err
+	}
+	if t.Status == "" {
+		return fmt.Errorf("Unknown request %s", rid)
+	}
+	err = owner(t, u)
+	if err != nil {
+		return err
+	}
+	children, err := TFC.Children(rid)
+	if err != nil {
+		return err
+	}
+	if len(children) == 0 {
+		if t.Status != "error" {
+			return fmt.Errorf("Request %s is %s, only failed requests can be retried", rid, t.Status)
+		}
+		return Dispatch(&t)
+	}
+	// group failed requests by their source agent
+	jobs := make(map[string][]Job)
+	for _, c := range children {
+		if c.Status != "error" {
+			continue
+		}
+		c.Status = "transferring"
+		c.Delay = 0
+		jobs[c.SrcUrl] = append(jobs[c.SrcUrl], Job{TransferRequest: c, Action: "transfer"})
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("Request %s has no failed transfers", rid)
+	}
+	count := 0
+	for src, srcJobs := range jobs {
+		routed, err := routeJobs(srcJobs)
+		if err != nil || len(routed) == 0 {
+			logs.WithFields(logs.Fields{
+				"Error":  err,
+				"Source": src,
+				"Parent": rid,
+			}).Error("Unable to route retried requests")
+			continue
+		}
+		err = SubmitRequest(routed, src, routed[0].TransferRequest.DstUrl)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error":  err,
+				"Source": src,
+				"Parent": rid,
+			}).Error("Unable to submit retried requests")
+			continue
+		}
+		for _, j := range srcJobs {
+			TFC.UpdateRequest(j.TransferRequest.Id, "transferring")
+			count++
+		}
+	}
+	if count == 0 {
+		return errors.New("Could not resubmit failed requests")
+	}
+	logs.WithFields(logs.Fields{
+		"Parent":   rid,
+		"Requests": count,
+	}).Info("Retry request group")
+	return TFC.UpdateRequest(rid, "transferring")
+}
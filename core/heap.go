@@ -8,13 +8,30 @@ package core
 
 import (
 	"container/heap"
+	"time"
 )
 
+// PriorityAging defines how long an item waits in a queue to gain one level
+// of priority, it prevents starvation of low priority jobs
+var PriorityAging = 10 * time.Minute
+
 // An Item is something we manage in a priority queue.
 type Item struct {
 	Value    TransferRequest
 	priority int
 	index    int
+	action   string    // action of the job held by JobQueue
+	since    time.Time // time item is queued, zero time disables aging
+}
+
+// rank returns priority of the item raised by its waiting time. All items age
+// at the same rate, therefore we count the waiting time from the Unix epoch and
+// the order of items in the heap does not change over time.
+func (item *Item) rank() float64 {
+	if item.since.IsZero() || PriorityAging <= 0 {
+		return float64(item.priority)
+	}
+	return float64(item.priority) - float64(item.since.UnixNano())/float64(PriorityAging)
 }
 
 // A PriorityQueue implements heap.Interface and holds Items.
@@ -26,7 +43,7 @@ func (pq PriorityQueue) Len() int { return len(pq) }
 // Less provides less function for PriorityQueue
 func (pq PriorityQueue) Less(i, j int) bool {
 	// We want Pop to give us the highest, not lowest, priority so we use greater than here.
-	return pq[i].priority > pq[j].priority
+	return pq[i].rank() > pq[j].rank()
 }
 
 // Swap provides swap function for PriorityQueue
@@ -64,8 +81,8 @@ func (pq *PriorityQueue) Delete(rid string) bool {
 		}
 	}
 	// Varify request id exists in heap and then delete it
-	if index < RequestQueue.Len() && index >= 0 {
-		heap.Remove(&RequestQueue, index)
+	if index < pq.Len() && index >= 0 {
+		heap.Remove(pq, index)
 		return true
 	}
 	return false
@@ -86,3 +103,20 @@ func (pq *PriorityQueue) update(item *Item, value TransferRequest, priority int)
 	item.priority = priority
 	heap.Fix(pq, item.index)
 }
+
+// Reprioritize changes priority of items of given request and its derived
+// requests, it returns number of updated items
+func (pq *PriorityQueue) Reprioritize(rid string, priority int) int {
+	var items []*Item
+	for _, item := range *pq {
+		if item.Value.Id == rid || item.Value.Parent == rid {
+			items = append(items, item)
+		}
+	}
+	for _, item := range items {
+		value := item.Value
+		value.Priority = priority
+		pq.update(item, value, priority)
+	}
+	return len(items)
+}
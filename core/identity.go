@@ -0,0 +1,188 @@
+package core
+
+// transfer2go identity providers, they provide list of users (DNs) and their groups
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Identity represents user known to identity provider
+type Identity struct {
+	DN     string   `json:"dn"`     // user DN
+	Groups []string `json:"groups"` // user groups
+}
+
+// IdentityProvider provides list of known user identities
+type IdentityProvider interface {
+	Identities() ([]Identity, error)
+}
+
+// FileProvider reads identities from JSON file with list of identities
+type FileProvider struct {
+	Path string // file name
+}
+
+// Identities implements IdentityProvider interface
+func (p FileProvider) Identities() ([]Identity, error) {
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	var out []Identity
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+// HTTPProvider fetches identities from HTTP end-point which returns JSON list of identities
+type HTTPProvider struct {
+	Url string // end-point url
+}
+
+// Identities implements IdentityProvider interface
+func (p HTTPProvider) Identities() ([]Identity, error) {
+	resp := utils.FetchResponse(p.Url, []byte{})
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Response %s, error=%s", resp.Status, string(resp.Data))
+	}
+	var out []Identity
+	err := json.Unmarshal(resp.Data, &out)
+	return out, err
+}
+
+// StaticProvider provides static allow-list of DNs
+type StaticProvider struct {
+	DNs []string // list of allowed DNs
+}
+
+// Identities implements IdentityProvider interface
+func (p StaticProvider) Identities() ([]Identity, error) {
+	var out []Identity
+	for _, dn := range p.DNs {
+		out = append(out, Identity{DN: dn})
+	}
+	return out, nil
+}
+
+// NewIdentityProvider returns identity provider of given kind. The source is
+// a file name for file provider, url for http provider or semicolon separated
+// list of DNs for static provider.
+func NewIdentityProvider(kind, source string) (IdentityProvider, error) {
+	switch kind {
+	case "file":
+		return FileProvider{Path: source}, nil
+	case "http":
+		return HTTPProvider{Url: source}, nil
+	case "static":
+		var dns []string
+		for _, dn := range strings.Split(source, ";") {
+			if dn = strings.TrimSpace(dn); dn != "" {
+				dns = append(dns, dn)
+			}
+		}
+		return StaticProvider{DNs: dns}, nil
+	}
+	return nil, fmt.Errorf("Unknown identity provider %s", kind)
+}
+
+// IdentityRegistry keeps identities obtained from identity provider
+type IdentityRegistry struct {
+	sync.RWMutex
+	Provider  IdentityProvider    // identity provider
+	users     map[string][]string // user DN and its groups
+	timeStamp int64               // time stamp of last reload
+}
+
+// AgentIdentities holds identities known to the agent, nil registry means
+// that no user is known
+var AgentIdentities *IdentityRegistry
+
+// NewIdentityRegistry returns new instance of IdentityRegistry with identities
+// loaded from given provider
+func NewIdentityRegistry(provider IdentityProvider) (*IdentityRegistry, error) {
+	r := &IdentityRegistry{Provider: provider, users: make(map[string][]string)}
+	err := r.Reload()
+	return r, err
+}
+
+// Reload reloads identities from provider, the known identities are kept
+// if provider fails
+func (r *IdentityRegistry) Reload() error {
+	identities, err := r.Provider.Identities()
+	if err != nil {
+		return err
+	}
+	users := make(map[string][]string)
+	for _, i := range identities {
+		users[i.DN] = append(users[i.DN], i.Groups...)
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.users = users
+	r.timeStamp = time.Now().Unix()
+	return nil
+}
+
+// Refresh periodically reloads identities from provider
+func (r *IdentityRegistry) Refresh(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		err := r.Reload()
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error": err,
+			}).Error("Unable to reload identities")
+		}
+	}
+}
+
+// Known checks if given user DN is known to identity provider, nil registry
+// does not know anybody
+func (r *IdentityRegistry) Known(dn string) bool {
+	if r == nil {
+		return false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	_, ok := r.users[dn]
+	return ok
+}
+
+// Groups returns groups of given user DN
+func (r *IdentityRegistry) Groups(dn string) []string {
+	if r == nil {
+		return nil
+	}
+	r.RLock()
+	defer r.RUnlock()
+	return r.users[dn]
+}
+
+// Size returns number of known identities
+func (r *IdentityRegistry) Size() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.users)
+}
+
+// TimeStamp returns time stamp of last reload of identities
+func (r *IdentityRegistry) TimeStamp() int64 {
+	r.RLock()
+	defer r.RUnlock()
+	return r.timeStamp
+}
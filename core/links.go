@@ -0,0 +1,353 @@
+package core
+
+// transfer2go link graph and multi-hop routing module
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Hop represents single agent on a multi-hop transfer route
+type Hop struct {
+	Alias string   `json:"alias"`          // agent name
+	Url   string   `json:"url"`            // agent url
+	Lfns  []string `json:"lfns,omitempty"` // LFNs of temporary replicas created at relay agent
+}
+
+// LinkGraph represents connectivity between agents. The links are bidirectional,
+// agents which are not present in a graph are considered to be able to reach
+// any other agent directly, therefore empty graph represents full mesh.
+// The health and cost of the links are learned from active probes between agents.
+type LinkGraph struct {
+	sync.RWMutex
+	Links  map[string][]string // agent alias and list of aliases it can directly reach
+	Health map[string]bool     // health of probed links, the key is src->dst pair
+	Cost   map[string]float64  // cost of probed links, the key is src->dst pair
+	Agents *AgentRegistry      // registry of connected agents
+}
+
+// costSize defines amount of data in MB, the cost of the link is time in
+// seconds to transfer this amount of data over the link
+const costSize = 1024
+
+// defaultLinkCost defines cost of the link without measured throughput, it
+// corresponds to 100MB/s link
+const defaultLinkCost = costSize / 100.0
+
+// AgentLinks holds link graph used by main agent to route transfer requests
+var AgentLinks = &LinkGraph{}
+
+// String provides string representation of the hop
+func (h *Hop) String() string {
+	return fmt.Sprintf("<Hop alias=%s url=%s>", h.Alias, h.Url)
+}
+
+// NewLinkGraph returns new instance of LinkGraph type. The links are read from
+// given JSON file which holds a map of agent alias and list of agent aliases it
+// can directly reach, e.g. {"T3_A": ["T1_B"], "T1_B": ["T2_C"]}
+func NewLinkGraph(fname string, agents *AgentRegistry) (*LinkGraph, error) {
+	g := &LinkGraph{Links: make(map[string][]string), Health: make(map[string]bool), Agents: agents}
+	if fname == "" {
+		return g, nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return g, err
+	}
+	var links map[string][]string
+	err = json.Unmarshal(data, &links)
+	if err != nil {
+		return g, err
+	}
+	for src, dsts := range links {
+		for _, dst := range dsts {
+			g.AddLink(src, dst)
+		}
+	}
+	logs.WithFields(logs.Fields{
+		"File":  fname,
+		"Links": g.Links,
+	}).Println("Link graph")
+	return g, nil
+}
+
+// AddLink adds bidirectional link between two agents
+func (g *LinkGraph) AddLink(a, b string) {
+	g.Lock()
+	defer g.Unlock()
+	if g.Links == nil {
+		g.Links = make(map[string][]string)
+	}
+	if !utils.InList(b, g.Links[a]) {
+		g.Links[a] = append(g.Links[a], b)
+	}
+	if !utils.InList(a, g.Links[b]) {
+		g.Links[b] = append(g.Links[b], a)
+	}
+}
+
+// SetHealth records health of the link between source and destination agents
+func (g *LinkGraph) SetHealth(src, dst string, healthy bool) {
+	g.Lock()
+	defer g.Unlock()
+	if g.Health == nil {
+		g.Health = make(map[string]bool)
+	}
+	g.Health[fmt.Sprintf("%s->%s", src, dst)] = healthy
+}
+
+// SetMetrics records cost of the link between source and destination agents
+// from its latency (ms) and throughput (MB/s), the link without measured
+// throughput gets default cost
+func (g *LinkGraph) SetMetrics(src, dst string, latency, throughput float64) {
+	g.Lock()
+	defer g.Unlock()
+	if g.Cost == nil {
+		g.Cost = make(map[string]float64)
+	}
+	key := fmt.Sprintf("%s->%s", src, dst)
+	if throughput <= 0 {
+		delete(g.Cost, key)
+		return
+	}
+	g.Cost[key] = latency/1000 + costSize/throughput
+}
+
+// helper function to find cost of the link between agents, the cost of the
+// probed direction is used when the other one is not known
+func (g *LinkGraph) cost(a, b string) float64 {
+	if c, ok := g.Cost[fmt.Sprintf("%s->%s", a, b)]; ok {
+		return c
+	}
+	if c, ok := g.Cost[fmt.Sprintf("%s->%s", b, a)]; ok {
+		return c
+	}
+	return defaultLinkCost
+}
+
+// Direct checks if given agents can talk to each other directly
+func (g *LinkGraph) Direct(a, b string) bool {
+	g.RLock()
+	defer g.RUnlock()
+	return g.direct(a, b)
+}
+
+// helper function to check direct link between agents, the link is down only
+// if all its probed directions are unhealthy
+func (g *LinkGraph) direct(a, b string) bool {
+	hab, okab := g.Health[fmt.Sprintf("%s->%s", a, b)]
+	hba, okba := g.Health[fmt.Sprintf("%s->%s", b, a)]
+	if (okab || okba) && !hab && !hba {
+		return false
+	}
+	la, oka := g.Links[a]
+	lb, okb := g.Links[b]
+	if oka {
+		return utils.InList(b, la)
+	}
+	if okb {
+		return utils.InList(a, lb)
+	}
+	return true
+}
+
+// helper function to return list of agents known to the graph
+func (g *LinkGraph) aliases() []string {
+	var out []string
+	if g.Agents != nil {
+		for alias := range g.Agents.Map() {
+			out = append(out, alias)
+		}
+	}
+	for alias := range g.Links {
+		if !utils.InList(alias, out) {
+			out = append(out, alias)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Path finds the cheapest route between source and destination agents, the
+// cost of the route is sum of costs of its links. It returns list of
+// intermediate hops, the list is empty if the direct link is the cheapest route.
+func (g *LinkGraph) Path(src, dst string) ([]Hop, error) {
+	g.RLock()
+	defer g.RUnlock()
+	if src == dst {
+		return []Hop{}, nil
+	}
+	aliases := g.aliases()
+	// Dijkstra search over the graph, prev keeps track of reached agents
+	dist := map[string]float64{src: 0}
+	prev := map[string]string{}
+	done := map[string]bool{}
+	for {
+		node := ""
+		for _, n := range append([]string{src}, aliases...) {
+			if d, ok := dist[n]; ok && !done[n] && (node == "" || d < dist[node]) {
+				node = n
+			}
+		}
+		if node == "" || node == dst {
+			break
+		}
+		done[node] = true
+		for _, next := range aliases {
+			if next == node || done[next] || !g.direct(node, next) {
+				continue
+			}
+			d := dist[node] + g.cost(node, next)
+			if old, ok := dist[next]; !ok || d < old {
+				dist[next] = d
+				prev[next] = node
+			}
+		}
+	}
+	if _, ok := dist[dst]; !ok {
+		return nil, fmt.Errorf("No route from %s to %s", src, dst)
+	}
+	var hops []Hop
+	for node := prev[dst]; node != src; node = prev[node] {
+		hop := Hop{Alias: node, Url: g.url(node)}
+		if hop.Url == "" {
+			return nil, fmt.Errorf("Unable to resolve url of intermediate agent %s", node)
+		}
+		hops = append([]Hop{hop}, hops...)
+	}
+	return hops, nil
+}
+
+// helper function to resolve agent url from its alias
+func (g *LinkGraph) url(alias string) string {
+	if g.Agents == nil {
+		return ""
+	}
+	return g.Agents.Url(alias)
+}
+
+// helper function to redirect jobs through intermediate agents when source
+// agent can't reach destination one directly. The destination of the job is
+// replaced by the first hop while remaining hops are kept in its route.
+func routeJobs(jobs []Job) ([]Job, error) {
+	var out []Job
+	for _, j := range jobs {
+		t := j.TransferRequest
+		t.Route = nil
+		t.Relays = nil
+		hops, err := AgentLinks.Path(t.SrcAlias, t.DstAlias)
+		if err != nil {
+			return nil, err
+		}
+		if len(hops) > 0 {
+			dst := Hop{Alias: t.DstAlias, Url: AgentLinks.url(t.DstAlias)}
+			if dst.Url == "" {
+				return nil, fmt.Errorf("Unable to resolve url of destination agent %s", t.DstAlias)
+			}
+			t.Route = append(hops[1:], dst)
+			t.DstAlias = hops[0].Alias
+			t.DstUrl = hops[0].Url
+			logs.WithFields(logs.Fields{
+				"Request": t.String(),
+			}).Info("Request is routed through intermediate agents")
+		}
+		out = append(out, Job{TransferRequest: t, Action: j.Action})
+	}
+	return out, nil
+}
+
+// NextHop submits transfer job for the next leg of multi-hop route. The agent
+// which holds the data becomes the source of the next leg and, if it received
+// new replicas of the data, it is recorded as relay to be cleaned up later.
+func (j *Job) NextHop() error {
+	t := j.TransferRequest.Clone()
+	if lfns := j.TransferRequest.newLfns; len(lfns) > 0 {
+		t.Relays = append(t.Relays, Hop{Alias: t.DstAlias, Url: t.DstUrl, Lfns: lfns})
+	}
+	t.SrcAlias = t.DstAlias
+	t.SrcUrl = t.DstUrl
+	t.DstAlias = t.Route[0].Alias
+	t.DstUrl = t.Route[0].Url
+	t.Route = t.Route[1:]
+	t.Status = "transferring"
+	t.Delay = 0
+	logs.WithFields(logs.Fields{
+		"Request": t.String(),
+	}).Info("Submit next hop of the request")
+	next := Job{TransferRequest: t, Action: "transfer"}
+	err := SubmitRequest([]Job{next}, t.SrcUrl, t.DstUrl)
+	if err != nil {
+		// next leg is not going to happen, remove temporary replicas
+		next.CleanupRelays()
+	}
+	return err
+}
+
+// CleanupRelays asks intermediate agents to remove their temporary replicas,
+// it is called when transfer reaches its destination or it is abandoned
+func (j *Job) CleanupRelays() {
+	for _, relay := range j.TransferRequest.Relays {
+		t := j.TransferRequest.Clone()
+		t.Route = nil
+		t.Relays = []Hop{relay} // relay removes only replicas it got from this transfer
+		jobs := []Job{Job{TransferRequest: t, Action: "cleanup"}}
+		data, err := json.Marshal(jobs)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error": err,
+				"Relay": relay.String(),
+			}).Error("CleanupRelays unable to marshal jobs")
+			continue
+		}
+		furl := fmt.Sprintf("%s/action", relay.Url)
+		resp := utils.FetchResponse(furl, data) // POST request
+		if resp.Error != nil || resp.StatusCode != 200 {
+			logs.WithFields(logs.Fields{
+				"Error": resp.Error,
+				"Relay": relay.String(),
+			}).Error("CleanupRelays unable to send cleanup request to relay agent")
+		}
+	}
+}
+
+// Cleanup returns a Decorator that removes temporary replicas of relayed request
+// from local TFC and local storage, only replicas listed in relays of the
+// request are removed
+func Cleanup() Decorator {
+	return func(r Request) Request {
+		return RequestFunc(func(t *TransferRequest) error {
+			var records []CatalogEntry
+			for _, relay := range t.Relays {
+				for _, lfn := range relay.Lfns {
+					records = append(records, TFC.Records(TransferRequest{Lfn: lfn})...)
+				}
+			}
+			for _, rec := range records {
+				err := TFC.Delete(rec.Lfn)
+				if err != nil {
+					return err
+				}
+				if _, err := os.Stat(rec.Pfn); err == nil {
+					err = os.Remove(rec.Pfn)
+					if err != nil {
+						logs.WithFields(logs.Fields{
+							"Pfn":   rec.Pfn,
+							"Error": err,
+						}).Error("Unable to remove temporary replica")
+					}
+				}
+				logs.WithFields(logs.Fields{
+					"Entry": rec.String(),
+				}).Info("Temporary replica is removed")
+			}
+			return r.Process(t)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package core
+
+// transfer2go priority of transfer requests, it can be changed while request
+// jobs are queued at the agents
+
+import (
+	"fmt"
+
+	logs "github.com/sirupsen/logrus"
+)
+
+// Reprioritize changes priority of given request and its derived requests on
+// main agent, and asks agents which hold their jobs to reprioritize them
+func Reprioritize(rid string, priority int) error {
+	t := TransferRequest{Id: rid}
+	err := TFC.RetrieveRequest(&t)
+	if err != nil {
+		return err
+	}
+	if t.Status == "" {
+		return fmt.Errorf("Unknown request %s", rid)
+	}
+	err = TFC.UpdatePriority(rid, priority)
+	if err != nil {
+		return err
+	}
+	RequestQueueLock.Lock()
+	RequestQueue.Reprioritize(rid, priority)
+	RequestQueueLock.Unlock()
+	if t.Status == "transferring" {
+		// request is dispatched to agents
+		children, err := TFC.Children(rid)
+		if err != nil {
+			return err
+		}
+		t.Priority = priority
+		job := Job{TransferRequest: TransferRequest{Id: rid, Priority: priority}, Action: "reprioritize"}
+		go notifyHolders(job, append(children, t))
+	}
+	return nil
+}
+
+// ReprioritizeJobs changes priority of jobs of given request queued at this agent
+func ReprioritizeJobs(rid string, priority int) int {
+	count := TransferQueue.Reprioritize(rid, priority)
+	logs.WithFields(logs.Fields{
+		"Request":  rid,
+		"Priority": priority,
+		"Jobs":     count,
+	}).Info("Reprioritize queued jobs")
+	return count
+}
@@ -0,0 +1,234 @@
+package core
+
+// transfer2go quotas on submitted transfers per user and per destination site
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// defaultQuota is a key of quota applied to users or sites without explicit quota
+const defaultQuota = "*"
+
+// Quota defines limits on submitted transfers, zero value means no limit
+type Quota struct {
+	MaxPending     int64 `json:"maxPending"`     // max number of pending requests
+	MaxBytes       int64 `json:"maxBytes"`       // max number of bytes in flight
+	MaxBytesPerDay int64 `json:"maxBytesPerDay"` // max number of bytes submitted within a day
+}
+
+// QuotaUsage represents current usage of the quota
+type QuotaUsage struct {
+	Pending     int64 `json:"pending"`     // number of pending requests
+	Bytes       int64 `json:"bytes"`       // number of bytes in flight
+	BytesPerDay int64 `json:"bytesPerDay"` // number of bytes submitted within last day
+	Quota       Quota `json:"quota"`       // quota limits
+}
+
+// QuotaPolicy defines quotas per user DN and per destination site, the "*"
+// key defines default quota. Usage of admitted requests is reserved until
+// they are stored, QuotaPolicy is safe for concurrent use.
+type QuotaPolicy struct {
+	sync.Mutex
+	Users    map[string]Quota           `json:"users"` // user DN and its quota
+	Sites    map[string]Quota           `json:"sites"` // destination site alias and its quota
+	reserved map[string]TransferRequest // admitted requests which are not stored yet
+}
+
+// QuotaError represents request which exceeds the quota
+type QuotaError struct {
+	Kind  string // user or site
+	Name  string // user DN or site alias
+	Limit string // exceeded limit
+	Value int64  // value of the usage including the request
+	Max   int64  // quota limit
+}
+
+// Error implements error interface
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("Quota exceeded: %s %s %s %d > %d", e.Kind, e.Name, e.Limit, e.Value, e.Max)
+}
+
+// AgentQuotas holds quota policy of the agent, nil policy means no quotas
+var AgentQuotas *QuotaPolicy
+
+// LoadQuotas reads quota policy from given file, empty file name returns nil policy
+func LoadQuotas(fname string) (*QuotaPolicy, error) {
+	if fname == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var q QuotaPolicy
+	err = json.Unmarshal(data, &q)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// Quota returns quota of given user (kind=user) or destination site (kind=site),
+// the default quota is used if there is no explicit one
+func (p *QuotaPolicy) Quota(kind, name string) (Quota, bool) {
+	if p == nil {
+		return Quota{}, false
+	}
+	quotas := p.Users
+	if kind == "site" {
+		quotas = p.Sites
+	}
+	if q, ok := quotas[name]; ok {
+		return q, true
+	}
+	q, ok := quotas[defaultQuota]
+	return q, ok
+}
+
+// Check checks if quota usage increased by given number of pending requests and bytes fits into the quota
+func (q Quota) Check(kind, name string, usage QuotaUsage, pending, bytes int64) error {
+	if q.MaxPending > 0 && usage.Pending+pending > q.MaxPending {
+		return &QuotaError{Kind: kind, Name: name, Limit: "pending requests", Value: usage.Pending + pending, Max: q.MaxPending}
+	}
+	if q.MaxBytes > 0 && usage.Bytes+bytes > q.MaxBytes {
+		return &QuotaError{Kind: kind, Name: name, Limit: "bytes in flight", Value: usage.Bytes + bytes, Max: q.MaxBytes}
+	}
+	if q.MaxBytesPerDay > 0 && usage.BytesPerDay+bytes > q.MaxBytesPerDay {
+		return &QuotaError{Kind: kind, Name: name, Limit: "bytes per day", Value: usage.BytesPerDay + bytes, Max: q.MaxBytesPerDay}
+	}
+	return nil
+}
+
+// Check checks if given requests fit into quotas of their users and destination sites
+func (p *QuotaPolicy) Check(requests []TransferRequest) error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.check(requests)
+}
+
+// Reserve checks if given requests fit into quotas and reserves their usage
+// until they are stored, the reservation is released by Release
+func (p *QuotaPolicy) Reserve(requests []TransferRequest) error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	err := p.check(requests)
+	if err != nil {
+		return err
+	}
+	if p.reserved == nil {
+		p.reserved = make(map[string]TransferRequest)
+	}
+	for _, t := range requests {
+		p.reserved[t.Id] = t
+	}
+	return nil
+}
+
+// Release releases usage reserved by given request
+func (p *QuotaPolicy) Release(rid string) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	delete(p.reserved, rid)
+}
+
+// helper function to check given requests along with reserved ones, it should be called under lock
+func (p *QuotaPolicy) check(requests []TransferRequest) error {
+	type key struct{ kind, name string }
+	pending := make(map[key]int64)
+	bytes := make(map[key]int64)
+	reserved := make(map[key]QuotaUsage)
+	for _, t := range requests {
+		for _, k := range []key{key{"user", t.User}, key{"site", t.DstAlias}} {
+			if k.name == "" {
+				continue
+			}
+			pending[k]++
+			bytes[k] += t.Bytes
+		}
+	}
+	for _, t := range p.reserved {
+		for _, k := range []key{key{"user", t.User}, key{"site", t.DstAlias}} {
+			u := reserved[k]
+			u.Pending++
+			u.Bytes += t.Bytes
+			u.BytesPerDay += t.Bytes
+			reserved[k] = u
+		}
+	}
+	for k := range pending {
+		q, ok := p.Quota(k.kind, k.name)
+		if !ok {
+			continue
+		}
+		usage, err := TFC.QuotaUsage(k.kind, k.name)
+		if err != nil {
+			return err
+		}
+		usage.Pending += reserved[k].Pending
+		usage.Bytes += reserved[k].Bytes
+		usage.BytesPerDay += reserved[k].BytesPerDay
+		err = q.Check(k.kind, k.name, usage, pending[k], bytes[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage returns quota usage of given user and destination site, empty names are skipped
+func (p *QuotaPolicy) Usage(user, site string) (map[string]QuotaUsage, error) {
+	out := make(map[string]QuotaUsage)
+	for kind, name := range map[string]string{"user": user, "site": site} {
+		if name == "" {
+			continue
+		}
+		usage, err := TFC.QuotaUsage(kind, name)
+		if err != nil {
+			return nil, err
+		}
+		usage.Quota, _ = p.Quota(kind, name)
+		out[kind] = usage
+	}
+	return out, nil
+}
+
+// RequestBytes returns size of data of given request, the size is obtained
+// from catalog of source agent
+func RequestBytes(t TransferRequest) (int64, error) {
+	data, err := json.Marshal(TransferRequest{Lfn: t.Lfn, Block: t.Block, Dataset: t.Dataset})
+	if err != nil {
+		return 0, err
+	}
+	resp := utils.FetchResponse(fmt.Sprintf("%s/records", t.SrcUrl), data) // POST request
+	if resp.Error != nil {
+		return 0, resp.Error
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Source agent %s replied with status %d", t.SrcUrl, resp.StatusCode)
+	}
+	var records []CatalogEntry
+	err = json.Unmarshal(resp.Data, &records)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, rec := range records {
+		size += rec.Bytes
+	}
+	return size, nil
+}
@@ -0,0 +1,301 @@
+package core
+
+// transfer2go agent registry, it keeps track of known agents and their meta-data
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+)
+
+// states of the agent
+const (
+	AgentAlive   = "alive"   // agent sends heartbeats
+	AgentSuspect = "suspect" // agent missed few heartbeats
+	AgentDead    = "dead"    // agent is gone and deregistered
+)
+
+// number of missed heartbeats after which agent becomes suspect or dead
+const (
+	suspectHeartbeats = 3
+	deadHeartbeats    = 10
+)
+
+// types of agent registry events
+const (
+	AgentRegistered   = "register"   // new agent is registered or agent changed its url
+	AgentUpdated      = "update"     // agent meta-data or state is changed
+	AgentDeregistered = "deregister" // agent is gone
+)
+
+// AgentRecord represents agent meta-data known to the registry
+type AgentRecord struct {
+	Alias        string   `json:"alias"`        // agent name
+	Url          string   `json:"url"`          // agent url
+	Protocol     string   `json:"protocol"`     // agent transfer protocol
+	Backend      string   `json:"backend"`      // agent storage backend
+	Capabilities []string `json:"capabilities"` // agent capabilities, e.g. transfer model
+	Version      string   `json:"version"`      // agent version
+	LastSeen     int64    `json:"lastSeen"`     // time stamp of last heartbeat
+	State        string   `json:"state"`        // agent state: alive, suspect or dead
+}
+
+// AgentEvent represents change in agent registry
+type AgentEvent struct {
+	Type  string      // event type: register, update or deregister
+	Agent AgentRecord // agent record
+}
+
+// AgentRegistry keeps track of known agents, it is safe for concurrent use
+type AgentRegistry struct {
+	sync.RWMutex
+	agents      map[string]AgentRecord // agent alias and its record
+	subscribers []chan AgentEvent      // subscribers of registry events
+}
+
+// Agents holds registry of agents known to this agent
+var Agents = NewAgentRegistry()
+
+// NewAgentRegistry returns new instance of AgentRegistry type
+func NewAgentRegistry() *AgentRegistry {
+	return &AgentRegistry{agents: make(map[string]AgentRecord)}
+}
+
+// String provides string representation of agent record
+func (a *AgentRecord) String() string {
+	return fmt.Sprintf("<AgentRecord alias=%s url=%s protocol=%s backend=%s capabilities=%v version=%s lastSeen=%d state=%s>", a.Alias, a.Url, a.Protocol, a.Backend, a.Capabilities, a.Version, a.LastSeen, a.State)
+}
+
+// helper function to notify subscribers about registry change, subscriber
+// which does not keep up with events will miss them. It should be called
+// under lock.
+func (r *AgentRegistry) notify(etype string, rec AgentRecord) {
+	for _, ch := range r.subscribers {
+		select {
+		case ch <- AgentEvent{Type: etype, Agent: rec}:
+		default:
+		}
+	}
+}
+
+// helper function to persist changed agents, it should be called without
+// lock to not block the registry on database access
+func persistAgents(records []AgentRecord) {
+	if DB == nil {
+		return
+	}
+	for _, rec := range records {
+		err := TFC.PutAgent(rec)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Agent": rec.String(),
+				"Error": err,
+			}).Error("Unable to persist agent")
+		}
+	}
+}
+
+// Subscribe returns a channel which receives registry events
+func (r *AgentRegistry) Subscribe() <-chan AgentEvent {
+	r.Lock()
+	defer r.Unlock()
+	ch := make(chan AgentEvent, 100)
+	r.subscribers = append(r.subscribers, ch)
+	return ch
+}
+
+// Register adds or updates given agent in registry, empty meta-data of the
+// record does not override known one
+func (r *AgentRegistry) Register(rec AgentRecord) {
+	persistAgents(r.register(rec))
+}
+
+// helper function to register given agent, it returns changed records
+func (r *AgentRegistry) register(rec AgentRecord) []AgentRecord {
+	r.Lock()
+	defer r.Unlock()
+	prev, ok := r.agents[rec.Alias]
+	if ok && prev.Url == rec.Url {
+		if rec.Protocol == "" {
+			rec.Protocol = prev.Protocol
+		}
+		if rec.Backend == "" {
+			rec.Backend = prev.Backend
+		}
+		if len(rec.Capabilities) == 0 {
+			rec.Capabilities = prev.Capabilities
+		}
+		if rec.Version == "" {
+			rec.Version = prev.Version
+		}
+	}
+	rec.LastSeen = time.Now().Unix()
+	rec.State = AgentAlive
+	r.agents[rec.Alias] = rec
+	if !ok || prev.Url != rec.Url || prev.State == AgentDead {
+		r.notify(AgentRegistered, rec)
+	} else if prev.State != rec.State || prev.Protocol != rec.Protocol || prev.Backend != rec.Backend || prev.Version != rec.Version {
+		r.notify(AgentUpdated, rec)
+	} else {
+		return nil
+	}
+	return []AgentRecord{rec}
+}
+
+// Seen marks given agent as alive
+func (r *AgentRegistry) Seen(alias, aurl string) {
+	r.Register(AgentRecord{Alias: alias, Url: aurl})
+}
+
+// Deregister marks agent registered with given alias and url as dead
+func (r *AgentRegistry) Deregister(alias, aurl string) bool {
+	r.Lock()
+	rec, ok := r.agents[alias]
+	if !ok || rec.Url != aurl || rec.State == AgentDead {
+		r.Unlock()
+		return false
+	}
+	rec.State = AgentDead
+	r.agents[alias] = rec
+	r.notify(AgentDeregistered, rec)
+	r.Unlock()
+	persistAgents([]AgentRecord{rec})
+	return true
+}
+
+// Reap removes agents which are dead and were not seen within given timeout
+// from registry and persistent storage, it returns removed agents
+func (r *AgentRegistry) Reap(timeout time.Duration) []AgentRecord {
+	r.Lock()
+	var reaped []AgentRecord
+	for alias, rec := range r.agents {
+		if rec.State == AgentDead && time.Since(time.Unix(rec.LastSeen, 0)) >= timeout {
+			delete(r.agents, alias)
+			reaped = append(reaped, rec)
+		}
+	}
+	r.Unlock()
+	if DB == nil {
+		return reaped
+	}
+	for _, rec := range reaped {
+		err := TFC.DeleteAgent(rec.Alias)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Agent": rec.String(),
+				"Error": err,
+			}).Error("Unable to remove agent")
+		}
+	}
+	return reaped
+}
+
+// Check updates agent states based on time of their last heartbeat and
+// returns list of agents which became dead
+func (r *AgentRegistry) Check(interval time.Duration) []AgentRecord {
+	dead, changed := r.check(interval)
+	persistAgents(changed)
+	return dead
+}
+
+// helper function to update agent states, it returns agents which became
+// dead and all changed records
+func (r *AgentRegistry) check(interval time.Duration) ([]AgentRecord, []AgentRecord) {
+	r.Lock()
+	defer r.Unlock()
+	var dead, changed []AgentRecord
+	if interval <= 0 {
+		return dead, changed
+	}
+	for alias, rec := range r.agents {
+		if rec.State == AgentDead {
+			continue
+		}
+		missed := int64(time.Since(time.Unix(rec.LastSeen, 0)) / interval)
+		state := AgentAlive
+		if missed >= deadHeartbeats {
+			state = AgentDead
+		} else if missed >= suspectHeartbeats {
+			state = AgentSuspect
+		}
+		if state == rec.State {
+			continue
+		}
+		rec.State = state
+		r.agents[alias] = rec
+		changed = append(changed, rec)
+		if state == AgentDead {
+			dead = append(dead, rec)
+			r.notify(AgentDeregistered, rec)
+		} else {
+			r.notify(AgentUpdated, rec)
+		}
+	}
+	return dead, changed
+}
+
+// Get returns record of given agent
+func (r *AgentRegistry) Get(alias string) (AgentRecord, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	rec, ok := r.agents[alias]
+	return rec, ok
+}
+
+// Url returns url of given agent or empty string if agent is unknown or dead
+func (r *AgentRegistry) Url(alias string) string {
+	if rec, ok := r.Get(alias); ok && rec.State != AgentDead {
+		return rec.Url
+	}
+	return ""
+}
+
+// State returns state of given agent
+func (r *AgentRegistry) State(alias string) string {
+	rec, _ := r.Get(alias)
+	return rec.State
+}
+
+// Map returns map of aliases and urls of agents which are not dead
+func (r *AgentRegistry) Map() map[string]string {
+	r.RLock()
+	defer r.RUnlock()
+	out := make(map[string]string)
+	for alias, rec := range r.agents {
+		if rec.State != AgentDead {
+			out[alias] = rec.Url
+		}
+	}
+	return out
+}
+
+// List returns records of all known agents
+func (r *AgentRegistry) List() []AgentRecord {
+	r.RLock()
+	defer r.RUnlock()
+	var out []AgentRecord
+	for _, rec := range r.agents {
+		out = append(out, rec)
+	}
+	return out
+}
+
+// Load restores agents from persistent storage (AGENTS table). Restored agents
+// are considered suspects until we hear from them again.
+func (r *AgentRegistry) Load() error {
+	records, err := TFC.Agents()
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, rec := range records {
+		if rec.State != AgentDead {
+			rec.State = AgentSuspect
+		}
+		r.agents[rec.Alias] = rec
+	}
+	return nil
+}
@@ -36,6 +36,8 @@ type AgentStatus struct {
 	Metrics   map[string]int64  `json:"metrics"`  // agent metrics
 	CpuUsage  float64           `json:"cpuusage"` // percentage of cpu used
 	MemUsage  float64           `json:"memusage"` // Avg RAM used in MB
+	Throttle  ThrottleStatus    `json:"throttle"` // transfer limits and running transfers
+	Space     SpaceStatus       `json:"space"`    // free and reserved space of the pool
 }
 
 // Processor is an object who process' given task
@@ -88,7 +90,7 @@ func fileTransferRequest(c CatalogEntry, tr *TransferRequest) (*http.Response, e
 	done := make(chan error)
 	go func() {
 		url := fmt.Sprintf("%s/upload", tr.DstUrl)
-		req, err := http.NewRequest("POST", url, pr)
+		req, err := http.NewRequestWithContext(tr.Context(), "POST", url, pr)
 		if err != nil {
 			done <- err
 			return
@@ -106,6 +108,10 @@ func fileTransferRequest(c CatalogEntry, tr *TransferRequest) (*http.Response, e
 			done <- err
 			return
 		}
+		if resp.StatusCode == http.StatusInsufficientStorage {
+			done <- fmt.Errorf("Destination agent %s has no space", tr.DstAlias)
+			return
+		}
 		if resp.StatusCode != 200 {
 			done <- errors.New("Status Code is not 200")
 			return
@@ -118,7 +124,7 @@ func fileTransferRequest(c CatalogEntry, tr *TransferRequest) (*http.Response, e
 	}
 	// Use copy of writer to avoid deadlock condition
 	out := io.MultiWriter(part)
-	_, err = io.Copy(out, file)
+	_, err = io.Copy(out, AgentThrottle.Reader(tr.Context(), tr.SrcAlias, tr.DstAlias, file))
 	if err != nil {
 		return nil, err
 	}
@@ -178,6 +184,11 @@ func GetRecords(tr TransferRequest, agent string) ([]CatalogEntry, error) {
 	return records, nil
 }
 
+// GetDestFiles get catalog entries of transfer request from its destination agent
+func GetDestFiles(tr TransferRequest) ([]CatalogEntry, error) {
+	return GetRecords(tr, tr.DstUrl)
+}
+
 // ResolveRequest will resolve input transfer request into series of requests with
 // known lfn/block/dataset triplets
 func ResolveRequest(t TransferRequest) []TransferRequest {
@@ -196,6 +207,8 @@ func ResolveRequest(t TransferRequest) []TransferRequest {
 		tr.Lfn = r.Lfn
 		tr.Block = r.Block
 		tr.Dataset = r.Dataset
+		tr.Bytes = r.Bytes
+		tr.Parent = t.Id
 		tr.Id = tr.UUID()
 		out = append(out, tr)
 	}
@@ -293,9 +306,27 @@ func RedirectRequest(t *TransferRequest) error {
 			}).Info("Unable to connect to source")
 			continue
 		}
-		err = SubmitRequest(selectedAgents[i].Jobs, selectedAgents[i].SrcUrl, t.DstUrl)
+		// route jobs through intermediate agents if source can't reach destination
+		jobs, err := routeJobs(selectedAgents[i].Jobs)
+		if err != nil || len(jobs) == 0 {
+			logs.WithFields(logs.Fields{
+				"Error":       err,
+				"Source":      selectedAgents[i].SrcAlias,
+				"Destination": t.DstAlias,
+			}).Error("Unable to route request")
+			continue
+		}
+		// derived requests are recorded to track progress of their parent
+		insertChildren(jobs)
+		err = SubmitRequest(jobs, selectedAgents[i].SrcUrl, jobs[0].TransferRequest.DstUrl)
 		if err == nil {
 			transferCount += 1
+		} else {
+			for _, j := range jobs {
+				if j.TransferRequest.Parent != "" {
+					TFC.UpdateRequest(j.TransferRequest.Id, "error")
+				}
+			}
 		}
 	}
 	if transferCount == 0 {
@@ -304,8 +335,24 @@ func RedirectRequest(t *TransferRequest) error {
 	return nil
 }
 
-// Compare two CatalogEntry
-func compareRecords(requestedCatalog []CatalogEntry, remoteCatalog []CatalogEntry) []CatalogEntry {
+// helper function to insert derived requests of given jobs into REQUESTS table
+func insertChildren(jobs []Job) {
+	for _, j := range jobs {
+		if j.TransferRequest.Parent == "" {
+			continue
+		}
+		err := TFC.InsertRequest(j.TransferRequest, "transferring")
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error":   err,
+				"Request": j.TransferRequest.String(),
+			}).Error("Unable to insert derived request")
+		}
+	}
+}
+
+// CompareRecords compares two lists of catalog entries and returns requested entries missing in remote catalog
+func CompareRecords(requestedCatalog []CatalogEntry, remoteCatalog []CatalogEntry) []CatalogEntry {
 	var records []CatalogEntry
 	files := make(map[string]string) // Create a hashmap of files to reduce the time complexity of comparison
 	for _, rec := range remoteCatalog {
@@ -333,11 +380,15 @@ func Store() Decorator {
 				Value:    *t,
 				priority: t.Priority,
 			}
-			err := TFC.InsertRequest(*t)
+			err := TFC.InsertRequest(*t, "pending")
+			// usage of stored request is accounted by the catalog
+			AgentQuotas.Release(t.Id)
 			if err != nil {
 				return err
 			}
+			RequestQueueLock.Lock()
 			heap.Push(&RequestQueue, item)
+			RequestQueueLock.Unlock()
 			logs.WithFields(logs.Fields{
 				"Request": t,
 			}).Println("Request Saved")
@@ -354,7 +405,9 @@ func Delete() Decorator {
 			err := TFC.UpdateRequest(t.Id, "deleted")
 
 			if err == nil {
+				RequestQueueLock.Lock()
 				deleted := RequestQueue.Delete(t.Id)
+				RequestQueueLock.Unlock()
 				if deleted {
 					logs.WithFields(logs.Fields{
 						"Request": t,
@@ -397,18 +450,59 @@ func PullTransfer() Decorator {
 				return r.Process(t) // nothing to do since we have this record in TFC
 			}
 
-			// try to download a file from remote agent
+			// reserve space in local pool, the transfer is retried later if it does not fit
+			err := AgentSpace.Reserve(t.Id, t.Bytes)
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Request": t.String(),
+					"Error":   err,
+				}).Warn("Request Transfer (pull model), unable to reserve space")
+				return err
+			}
+			defer AgentSpace.Release(t.Id)
+
+			// find size and hash of the file in source catalog to verify received data
+			var size int64
+			var srcHash string
+			if records, e := GetRecords(*t, t.SrcUrl); e == nil {
+				for _, rec := range records {
+					if rec.Lfn == t.Lfn {
+						size, srcHash = rec.Bytes, rec.Hash
+					}
+				}
+			}
+
+			// wait for transfer slot of the link and try to download a file from remote agent
+			release, err := AgentThrottle.Wait(t.Context(), t.SrcAlias, t.DstAlias)
+			if err != nil {
+				return err
+			}
+			defer release()
 			time0 := time.Now().Unix()
-			url := fmt.Sprintf("%s/download?lfn=%s", t.SrcUrl, url.QueryEscape(t.Lfn))
-			resp := utils.FetchResponse(url, []byte{})
-			if resp.Error != nil {
+			rurl := fmt.Sprintf("%s/download?lfn=%s&dst=%s", t.SrcUrl, url.QueryEscape(t.Lfn), url.QueryEscape(t.DstAlias))
+			req, err := http.NewRequestWithContext(t.Context(), "GET", rurl, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := utils.HttpClient().Do(req)
+			if err != nil {
 				logs.WithFields(logs.Fields{
-					"Request":             t.String(),
-					"Response.Error":      resp.Error,
-					"Response.Status":     resp.Status,
-					"Response.StatusCode": resp.StatusCode,
+					"Request": t.String(),
+					"Error":   err,
 				}).Error("Request Transfer (pull model), response error")
-				return resp.Error
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusTooManyRequests {
+				// source agent reached its transfer limits, we'll try later
+				return fmt.Errorf("Source agent %s is busy", t.SrcAlias)
+			}
+			if resp.StatusCode == http.StatusNotFound {
+				return fmt.Errorf("File %s is missing on source agent %s", t.Lfn, t.SrcAlias)
+			}
+			if resp.StatusCode != 200 && resp.StatusCode != 204 {
+				msg, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("Source agent %s responded %s, error=%s", t.SrcAlias, resp.Status, string(msg))
 			}
 			if resp.StatusCode == 204 {
 				// transfer was put into stager but not yet finished
@@ -419,14 +513,25 @@ func PullTransfer() Decorator {
 			}
 			if resp.StatusCode == 200 {
 				// we got data add record into local catalog
-				data := resp.Data
-				// call local stager to put data into local pool and/or tape system
-				pfn, bytes, hash, err := AgentStager.Write(data, t.Lfn)
+				if t.Bytes == 0 && resp.ContentLength > 0 {
+					// reserve space of the file we're going to receive
+					err = AgentSpace.Reserve(t.Id, resp.ContentLength)
+					if err != nil {
+						return err
+					}
+				}
+				// call local stager to stream data into local pool and/or tape system
+				pfn, bytes, hash, err := StoreFile(AgentStager, t.Lfn, resp.Body, size, srcHash)
+				if err == nil && t.Cancelled() {
+					// remove file of cancelled transfer from local pool
+					AgentStager.Remove(t.Lfn)
+					err = t.Context().Err()
+				}
 				if err != nil {
 					logs.WithFields(logs.Fields{
 						"Request": t.String(),
 						"Error":   err,
-					}).Error("Request Transfer (pull model), AgentStager.Write error")
+					}).Error("Request Transfer (pull model), AgentStager error")
 					return err
 				}
 				time1 := time.Now().Unix()
@@ -440,6 +545,7 @@ func PullTransfer() Decorator {
 				}).Info("Request Transfer (pull model), successfully added to this agent")
 				// change status of the processed request
 				t.Status = ""
+				t.newLfns = append(t.newLfns, t.Lfn)
 				// record how much we transferred
 				AgentMetrics.TotalBytes.Inc(bytes) // keep growing
 				AgentMetrics.Total.Inc(1)          // keep growing
@@ -465,10 +571,12 @@ func PushTransfer() Decorator {
 			requestedRecords := TFC.Records(*t)
 			// Check if the requested data is already presented on destination agent.
 			remoteRecords, err := GetRecords(*t, t.DstUrl)
+			// transferred records are new replicas only if we know destination did not have them
+			known := err == nil
 			if remoteRecords == nil || err != nil {
 				records = requestedRecords
 			} else {
-				records = compareRecords(requestedRecords, remoteRecords) // Filter the matching records
+				records = CompareRecords(requestedRecords, remoteRecords) // Filter the matching records
 			}
 
 			if len(records) == 0 {
@@ -489,6 +597,10 @@ func PushTransfer() Decorator {
 			if err != nil {
 				return err
 			}
+			if dstAgent.Space.Full {
+				// destination pool reached its high watermark, we'll try later
+				return fmt.Errorf("Destination agent %s has no space", t.DstAlias)
+			}
 			url = fmt.Sprintf("%s/status", t.SrcUrl)
 			resp = utils.FetchResponse(url, []byte{})
 			if resp.Error != nil {
@@ -506,6 +618,16 @@ func PushTransfer() Decorator {
 			// Overwrite the previous error status
 			t.Status = ""
 			for _, rec := range records {
+				if t.Cancelled() {
+					break // request is cancelled, we register what we already transferred
+				}
+
+				// wait for transfer slot of the link
+				var release func()
+				release, err = AgentThrottle.Wait(t.Context(), t.SrcAlias, t.DstAlias)
+				if err != nil {
+					break // request is cancelled
+				}
 
 				time0 := time.Now().Unix()
 
@@ -519,6 +641,7 @@ func PushTransfer() Decorator {
 						"dstAgent": dstAgent.String(),
 					}).Info("Transfer via HTTP protocol to")
 					rpfn, throughput, err = httpTransfer(rec, t)
+					release()
 					if err != nil {
 						logs.WithFields(logs.Fields{
 							"TransferRequest": t.String(),
@@ -534,19 +657,30 @@ func PushTransfer() Decorator {
 						TFC.InsertTransfers(time.Now().Unix(), cusage, memUsage, throughput)
 					}
 				} else {
-					// construct remote PFN by using destination agent backend and record LFN
-					rpfn = fmt.Sprintf("%s%s", dstAgent.Backend, rec.Lfn)
+					// ask destination agent to map record LFN to its PFN of transfer protocol
+					rpfn, err = RemotePfn(t.DstUrl, srcAgent.Protocol, rec.Lfn)
+					if err != nil {
+						release()
+						logs.WithFields(logs.Fields{
+							"TransferRequest": t.String(),
+							"Record":          rec.String(),
+							"Err":             err,
+						}).Error("Unable to map LFN on destination agent")
+						t.Status = err.Error()
+						continue // if we fail on single record we continue with others
+					}
 					// perform transfer with the help of backend tool
 					var cmd *exec.Cmd
 					if srcAgent.ToolOpts == "" {
-						cmd = exec.Command(srcAgent.Tool, rec.Pfn, rpfn)
+						cmd = exec.CommandContext(t.Context(), srcAgent.Tool, rec.Pfn, rpfn)
 					} else {
-						cmd = exec.Command(srcAgent.Tool, srcAgent.ToolOpts, rec.Pfn, rpfn)
+						cmd = exec.CommandContext(t.Context(), srcAgent.Tool, srcAgent.ToolOpts, rec.Pfn, rpfn)
 					}
 					logs.WithFields(logs.Fields{
 						"Command": cmd,
 					}).Info("Transfer command")
 					err = cmd.Run()
+					release()
 					if err != nil {
 						logs.WithFields(logs.Fields{
 							"Tool":         srcAgent.Tool,
@@ -578,6 +712,14 @@ func PushTransfer() Decorator {
 			if resp.Error != nil {
 				return resp.Error
 			}
+			if known {
+				for _, rec := range trRecords {
+					t.newLfns = append(t.newLfns, rec.Lfn)
+				}
+			}
+			if t.Cancelled() {
+				return t.Context().Err()
+			}
 			return r.Process(t)
 		})
 	}
@@ -602,7 +744,11 @@ func Pause(interval time.Duration) Decorator {
 					"Request":  t,
 					"Interval": interval,
 				}).Println("TransferRequest is paused by")
-				time.Sleep(interval)
+				select {
+				case <-time.After(interval):
+				case <-t.Context().Done():
+					return t.Context().Err()
+				}
 			}
 			return r.Process(t)
 		})
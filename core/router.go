@@ -9,8 +9,10 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"reflect"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/robfig/cron"
 	"github.com/sajari/regression"
@@ -27,7 +29,7 @@ type Router struct {
 	CronInterval     string                 // Helps to set hourly based cron job
 	LinearRegression *regression.Regression // machine learning model
 	CSVfile          string                 // historical data file
-	Agents           *map[string]string     // list of connected agents
+	Agents           *AgentRegistry         // registry of connected agents
 }
 
 // SourceStats structure to store source informations
@@ -43,7 +45,7 @@ type SourceStats struct {
 var AgentRouter Router
 
 // NewRouter returns new instance of Router type
-func NewRouter(interval string, agent *map[string]string, csvFile string) *cron.Cron {
+func NewRouter(interval string, agents *AgentRegistry, csvFile string) *cron.Cron {
 	lr := new(regression.Regression)
 	lr.SetObserved("Get throughput")
 	lr.SetVar(0, "CPU usage")
@@ -52,14 +54,51 @@ func NewRouter(interval string, agent *map[string]string, csvFile string) *cron.
 	timeConfig := "@every " + interval // It works on this format - http://golang.org/pkg/time/#ParseDuration
 	c := cron.New()
 	c.AddFunc(timeConfig, train)
-	AgentRouter = Router{CronInterval: interval, Agents: agent, LinearRegression: lr, CSVfile: csvFile}
+	AgentRouter = Router{CronInterval: interval, Agents: agents, LinearRegression: lr, CSVfile: csvFile}
+	go AgentRouter.watch(agents.Subscribe())
 	return c
 }
 
+// retrainDelay defines how long router collects agent events before it is
+// retrained, such that churn of agents causes at most one retrain
+const retrainDelay = 30 * time.Second
+
+// helper function to watch changes of agent registry, the router is retrained
+// when new agent joins such that its historical data are taken into account.
+// The events are coalesced and router is retrained only if set of agents
+// differs from the one it was last retrained with.
+func (r *Router) watch(events <-chan AgentEvent) {
+	var trained map[string]string // agents router was retrained with
+	var timer <-chan time.Time
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			logs.WithFields(logs.Fields{
+				"Event": e.Type,
+				"Agent": e.Agent.String(),
+			}).Println("Router received agent event")
+			if e.Type == AgentRegistered && timer == nil {
+				timer = time.After(retrainDelay)
+			}
+		case <-timer:
+			timer = nil
+			agents := r.Agents.Map()
+			if reflect.DeepEqual(agents, trained) {
+				continue
+			}
+			trained = agents
+			train()
+		}
+	}
+}
+
 // Function to train the agent
 func train() {
 	var dataPoints []TransferData
-	for _, source := range *AgentRouter.Agents {
+	for _, source := range AgentRouter.Agents.Map() {
 		data, err := getHistory(source)
 		if err == nil {
 			dataPoints = append(dataPoints, data...)
@@ -219,7 +258,7 @@ func (r *Router) FindSource(tr *TransferRequest) ([]SourceStats, int, error) {
 		commonFiles := set.Intersection(filteredAgent[index].catalogSet, unionSet)
 		jobs := make([]Job, 0)
 		for _, lfn := range commonFiles.List() {
-			meta = fileData[lfn.(string)] // 0: dataset, 1: block name
+			meta = fileData[lfn.(string)] // 0: dataset, 1: block name, 2: size
 			// create a new cloned copy of transfer request and replace its attributes from router predictions
 			t := tr.Clone()
 			t.Lfn = lfn.(string)
@@ -227,6 +266,9 @@ func (r *Router) FindSource(tr *TransferRequest) ([]SourceStats, int, error) {
 			t.Block = meta[1]
 			t.SrcUrl = filteredAgent[index].SrcUrl
 			t.SrcAlias = filteredAgent[index].SrcAlias
+			t.Bytes, _ = strconv.ParseInt(meta[2], 10, 64)
+			t.Parent = tr.Id
+			t.Id = t.UUID()
 			t.Status = "transferring"
 			jobs = append(jobs, Job{Action: "transfer", TransferRequest: t})
 		}
@@ -241,7 +283,7 @@ func GetUnionCatalog(tRequest *TransferRequest) (*set.SetNonTS, []SourceStats, m
 	unionSet := set.NewNonTS()
 	filteredAgent := make([]SourceStats, 0)
 	fileData := make(map[string][]string)
-	for srcAlias, srcUrl := range *AgentRouter.Agents {
+	for srcAlias, srcUrl := range AgentRouter.Agents.Map() {
 		records, err := GetRecords(*tRequest, srcUrl)
 		if err != nil || len(records) <= 0 {
 			continue
@@ -249,7 +291,7 @@ func GetUnionCatalog(tRequest *TransferRequest) (*set.SetNonTS, []SourceStats, m
 		agentSet := set.NewNonTS()
 		for _, catalog := range records {
 			agentSet.Add(catalog.Lfn)
-			fileData[catalog.Lfn] = []string{catalog.Dataset, catalog.Block}
+			fileData[catalog.Lfn] = []string{catalog.Dataset, catalog.Block, fmt.Sprintf("%d", catalog.Bytes)}
 		}
 		unionSet.Merge(agentSet)
 		agentStat := SourceStats{SrcUrl: srcUrl, SrcAlias: srcAlias, catalogSet: agentSet}
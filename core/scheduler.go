@@ -0,0 +1,301 @@
+package core
+
+// transfer2go job scheduler, it holds jobs of the agent in a bounded ready
+// queue along with delayed jobs which become ready after their delay
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned when job queue can't admit more jobs
+var ErrQueueFull = errors.New("Job queue is full")
+
+// delayedJob represents a job which becomes ready at given time
+type delayedJob struct {
+	job   Job
+	ready time.Time
+}
+
+// delayedJobs implements heap.Interface and orders jobs by their ready time
+type delayedJobs []delayedJob
+
+func (d delayedJobs) Len() int            { return len(d) }
+func (d delayedJobs) Less(i, j int) bool  { return d[i].ready.Before(d[j].ready) }
+func (d delayedJobs) Swap(i, j int)       { d[i], d[j] = d[j], d[i] }
+func (d *delayedJobs) Push(x interface{}) { *d = append(*d, x.(delayedJob)) }
+func (d *delayedJobs) Pop() interface{} {
+	old := *d
+	n := len(old)
+	item := old[n-1]
+	*d = old[:n-1]
+	return item
+}
+
+// flowKey identifies jobs of a destination and a user
+type flowKey struct {
+	dst  string
+	user string
+}
+
+// flow holds ready jobs of a destination and a user
+type flow struct {
+	key     flowKey
+	jobs    PriorityQueue // ready jobs of the flow
+	deficit float64       // number of jobs the flow may take in its turn
+	turn    bool          // indicates that flow is served in current round
+}
+
+// FlowStatus represents ready jobs of a destination and a user in the queue
+type FlowStatus struct {
+	Destination string  `json:"destination"` // destination alias
+	User        string  `json:"user"`        // user name
+	Weight      float64 `json:"weight"`      // weight of the flow
+	Jobs        int     `json:"jobs"`        // number of ready jobs
+}
+
+// JobQueue represents bounded queue of jobs. Jobs with a delay and scheduled
+// transfers are kept aside until they become ready. Ready jobs are kept in flows of destinations and
+// users which are served by deficit round-robin according to their weights,
+// within a flow jobs are handed to workers in order of their priority raised
+// by the time they wait in the queue. The JobQueue is safe for concurrent use.
+type JobQueue struct {
+	sync.Mutex
+	Capacity int               // maximum number of queued jobs, zero means unbounded
+	flows    map[flowKey]*flow // flows with ready jobs
+	active   []*flow           // flows with ready jobs in round-robin order
+	cursor   int               // position of served flow in active flows
+	ready    int               // number of ready jobs
+	delayed  delayedJobs       // jobs waiting for their delay to expire
+	wake     chan struct{}     // wakes up a worker waiting for a job
+}
+
+// NewJobQueue returns new instance of JobQueue type
+func NewJobQueue(capacity int) *JobQueue {
+	return &JobQueue{Capacity: capacity, flows: make(map[flowKey]*flow), wake: make(chan struct{}, 1)}
+}
+
+// helper function to wake up one of waiting workers
+func (q *JobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// helper function to find time when given job becomes ready. The job is held
+// for its delay, transfers are also held until their not before time and
+// transfer window of the agent, but not beyond their deadline.
+func readyTime(job Job, now time.Time) time.Time {
+	t := job.TransferRequest
+	ready := now.Add(time.Duration(t.Delay) * time.Second)
+	if job.Action != "transfer" {
+		return ready
+	}
+	if nbf := time.Unix(t.NotBefore, 0); t.NotBefore > 0 && nbf.After(ready) {
+		ready = nbf
+	}
+	ready = AgentWindows.Next(ready)
+	// request expires once its deadline second is passed, the job is held
+	// until then so the worker finds it expired rather than not ready
+	if expiry := time.Unix(t.Deadline+1, 0); t.Deadline > 0 && ready.After(expiry) {
+		ready = expiry
+	}
+	return ready
+}
+
+// helper function to put a job either to ready or delayed jobs, it should be called under lock
+func (q *JobQueue) put(job Job) {
+	now := time.Now()
+	if job.since.IsZero() {
+		job.since = now
+	}
+	if ready := readyTime(job, now); ready.After(now) {
+		heap.Push(&q.delayed, delayedJob{job: job, ready: ready})
+	} else {
+		q.push(job)
+	}
+}
+
+// helper function to put a job to ready jobs of its flow, it should be called under lock
+func (q *JobQueue) push(job Job) {
+	key := flowKey{dst: job.TransferRequest.DstAlias, user: job.TransferRequest.User}
+	f, ok := q.flows[key]
+	if !ok {
+		f = &flow{key: key}
+		q.flows[key] = f
+		q.active = append(q.active, f)
+	}
+	item := &Item{Value: job.TransferRequest, priority: job.TransferRequest.Priority, action: job.Action, since: job.since}
+	heap.Push(&f.jobs, item)
+	q.ready++
+}
+
+// helper function to take a ready job by deficit round-robin over the flows,
+// every turn a flow gets its weight worth of jobs. The weights are normalized
+// to the smallest one, therefore every round serves at least one job whatever
+// the weights are. It should be called under lock.
+func (q *JobQueue) pop() *Item {
+	if len(q.active) == 0 {
+		return nil
+	}
+	quanta := make([]float64, len(q.active))
+	least := 0.0
+	for i, f := range q.active {
+		quanta[i] = AgentShares.Weight(f.key.dst, f.key.user)
+		if least == 0 || quanta[i] < least {
+			least = quanta[i]
+		}
+	}
+	for len(q.active) > 0 {
+		if q.cursor >= len(q.active) {
+			q.cursor = 0
+		}
+		f := q.active[q.cursor]
+		if !f.turn {
+			f.turn = true
+			if least > 0 {
+				f.deficit += quanta[q.cursor] / least
+			} else {
+				f.deficit++
+			}
+		}
+		if f.deficit >= 1 {
+			f.deficit--
+			item := heap.Pop(&f.jobs).(*Item)
+			q.ready--
+			if f.jobs.Len() == 0 {
+				// flow without jobs leaves the round, its deficit is not kept
+				delete(q.flows, f.key)
+				q.active = append(q.active[:q.cursor], q.active[q.cursor+1:]...)
+			}
+			return item
+		}
+		f.turn = false
+		q.cursor++
+	}
+	return nil
+}
+
+// Submit admits given jobs to the queue, either all jobs are admitted or
+// ErrQueueFull is returned when queue does not have room for them
+func (q *JobQueue) Submit(jobs ...Job) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.Capacity > 0 && q.ready+len(q.delayed)+len(jobs) > q.Capacity {
+		return ErrQueueFull
+	}
+	for _, job := range jobs {
+		q.put(job)
+	}
+	q.notify()
+	return nil
+}
+
+// Requeue puts back a job which was already admitted, e.g. a job which is put
+// on hold by the worker. It is not subject to queue capacity and never blocks.
+func (q *JobQueue) Requeue(job Job) {
+	q.Lock()
+	defer q.Unlock()
+	q.put(job)
+	q.notify()
+}
+
+// Next waits for a ready job, it returns false when given context is done
+func (q *JobQueue) Next(ctx context.Context) (Job, bool) {
+	for {
+		if ctx.Err() != nil {
+			return Job{}, false
+		}
+		q.Lock()
+		now := time.Now()
+		for len(q.delayed) > 0 && !q.delayed[0].ready.After(now) {
+			item := heap.Pop(&q.delayed).(delayedJob)
+			q.push(item.job)
+		}
+		if item := q.pop(); item != nil {
+			job := Job{TransferRequest: item.Value, Action: item.action, since: item.since}
+			if q.ready > 0 || len(q.delayed) > 0 {
+				q.notify() // let other workers pick up remaining jobs
+			}
+			q.Unlock()
+			return job, true
+		}
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if len(q.delayed) > 0 {
+			timer = time.NewTimer(q.delayed[0].ready.Sub(now))
+			expired = timer.C
+		}
+		q.Unlock()
+		select {
+		case <-q.wake:
+		case <-expired:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Len returns number of ready and delayed jobs in the queue
+func (q *JobQueue) Len() (int, int) {
+	q.Lock()
+	defer q.Unlock()
+	return q.ready, len(q.delayed)
+}
+
+// Flows returns status of flows with ready jobs
+func (q *JobQueue) Flows() []FlowStatus {
+	q.Lock()
+	defer q.Unlock()
+	var out []FlowStatus
+	for _, f := range q.active {
+		w := AgentShares.Weight(f.key.dst, f.key.user)
+		out = append(out, FlowStatus{Destination: f.key.dst, User: f.key.user, Weight: w, Jobs: f.jobs.Len()})
+	}
+	return out
+}
+
+// Reprioritize changes priority of queued jobs of given request and its derived
+// requests, it returns number of updated jobs
+func (q *JobQueue) Reprioritize(rid string, priority int) int {
+	q.Lock()
+	defer q.Unlock()
+	count := 0
+	for _, f := range q.active {
+		count += f.jobs.Reprioritize(rid, priority)
+	}
+	for i, item := range q.delayed {
+		if item.job.TransferRequest.Id == rid || item.job.TransferRequest.Parent == rid {
+			q.delayed[i].job.TransferRequest.Priority = priority
+			count++
+		}
+	}
+	return count
+}
+
+// helper function to take all jobs from the queue
+func (q *JobQueue) drain() []Job {
+	q.Lock()
+	defer q.Unlock()
+	var jobs []Job
+	for _, f := range q.active {
+		for _, item := range f.jobs {
+			jobs = append(jobs, Job{TransferRequest: item.Value, Action: item.action, since: item.since})
+		}
+	}
+	for _, item := range q.delayed {
+		jobs = append(jobs, item.job)
+	}
+	q.flows = make(map[flowKey]*flow)
+	q.active = nil
+	q.cursor = 0
+	q.ready = 0
+	q.delayed = nil
+	return jobs
+}
@@ -0,0 +1,126 @@
+package core
+
+// transfer2go graceful shutdown of the agent, jobs which are not processed
+// before shutdown are persisted and restored after restart
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+)
+
+// abortTimeout defines how long we wait for aborted transfers to return
+const abortTimeout = 10 * time.Second
+
+// jobList holds jobs which were not processed because of agent shutdown
+type jobList struct {
+	sync.Mutex
+	jobs []Job
+}
+
+// add adds given job to the list
+func (l *jobList) add(job Job) {
+	l.Lock()
+	defer l.Unlock()
+	l.jobs = append(l.jobs, job)
+}
+
+// take returns all jobs and clears the list
+func (l *jobList) take() []Job {
+	l.Lock()
+	defer l.Unlock()
+	jobs := l.jobs
+	l.jobs = nil
+	return jobs
+}
+
+// unfinished holds jobs interrupted by agent shutdown
+var unfinished jobList
+
+// Shutdown waits until workers of given dispatchers finish their jobs, running
+// transfers are aborted when given context is done. Afterwards the jobs which
+// were not processed are persisted in JOBS table. The context of dispatchers
+// should be cancelled before calling Shutdown.
+func Shutdown(ctx context.Context, dispatchers ...*Dispatcher) error {
+	done := make(chan struct{})
+	go func() {
+		for _, d := range dispatchers {
+			d.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		count := AgentTransfers.Abort()
+		logs.WithFields(logs.Fields{
+			"Transfers": count,
+		}).Warn("Shutdown deadline is reached, abort running transfers")
+		select {
+		case <-done:
+		case <-time.After(abortTimeout):
+			logs.Error("Workers did not stop in time")
+		}
+	}
+	jobs := unfinished.take()
+	jobs = append(jobs, StorageQueue.drain()...)
+	jobs = append(jobs, TransferQueue.drain()...)
+	return persistJobs(jobs)
+}
+
+// helper function to persist given jobs in JOBS table, a job which can't be
+// persisted is logged and we continue with the others
+func persistJobs(jobs []Job) error {
+	var failed int
+	var lastErr error
+	for _, job := range jobs {
+		job.TransferRequest.ctx = nil
+		err := TFC.InsertJob(job)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Job":   job.String(),
+				"Error": err,
+			}).Error("Unable to persist job")
+			failed++
+			lastErr = err
+		}
+	}
+	logs.WithFields(logs.Fields{
+		"Jobs":   len(jobs) - failed,
+		"Failed": failed,
+	}).Println("Persisted unprocessed jobs")
+	if failed > 0 {
+		return fmt.Errorf("Unable to persist %d of %d jobs, last error: %v", failed, len(jobs), lastErr)
+	}
+	return nil
+}
+
+// helper function to put jobs persisted before agent shutdown back to the
+// queues, these jobs were admitted before and are not subject to queue capacity
+func restoreJobs() {
+	jobs, err := TFC.Jobs()
+	if err == nil {
+		err = TFC.DeleteJobs()
+	}
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("Unable to restore jobs")
+		return
+	}
+	if len(jobs) > 0 {
+		logs.WithFields(logs.Fields{
+			"Jobs": len(jobs),
+		}).Println("Jobs restored from db")
+	}
+	for _, job := range jobs {
+		if job.Action == "store" {
+			StorageQueue.Requeue(job)
+		} else {
+			TransferQueue.Requeue(job)
+		}
+	}
+}
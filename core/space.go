@@ -0,0 +1,187 @@
+package core
+
+// transfer2go disk space admission, destination agent reserves space of
+// accepted transfers and rejects transfers which do not fit into its pool
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// ErrNoSpace is returned when there is not enough space for a transfer
+var ErrNoSpace = errors.New("Not enough space in the pool")
+
+// Watermarks represents fractions of used space of the pool. When used space
+// along with reservations exceeds high watermark the pool does not accept
+// transfers until used space drops below low watermark.
+type Watermarks struct {
+	High float64 `json:"high"` // fraction of used space to stop accepting transfers, default 0.95
+	Low  float64 `json:"low"`  // fraction of used space to resume accepting transfers, default 0.90
+}
+
+// SpaceStatus represents space of the pool, the pool which spans several areas
+// is represented by the area with least free space
+type SpaceStatus struct {
+	Path       string     `json:"path"`       // pool area
+	Total      uint64     `json:"total"`      // total space in bytes
+	Free       uint64     `json:"free"`       // free space in bytes
+	Reserved   int64      `json:"reserved"`   // space in bytes reserved by running transfers
+	Watermarks Watermarks `json:"watermarks"` // watermarks of the pool
+	Full       bool       `json:"full"`       // indicates that pool does not accept transfers
+}
+
+// DiskSpace keeps track of space reserved by transfers in the pool, it is
+// safe for concurrent use
+type DiskSpace struct {
+	sync.Mutex
+	paths    []string         // pool areas, no areas means that space is not checked
+	marks    Watermarks       // watermarks of the pool
+	reserved map[string]int64 // reserved space of transfers
+	full     bool             // pool reached high watermark
+}
+
+// AgentSpace keeps track of space of the agent pool
+var AgentSpace = NewDiskSpace("")
+
+// NewDiskSpace returns new instance of DiskSpace type with default watermarks
+func NewDiskSpace(path string) *DiskSpace {
+	s := &DiskSpace{marks: Watermarks{High: 0.95, Low: 0.90}, reserved: make(map[string]int64)}
+	s.SetPath(path)
+	return s
+}
+
+// Validate checks that watermarks are fractions and low watermark does not exceed high one
+func (m Watermarks) Validate() error {
+	if m.High <= 0 || m.High > 1 || m.Low <= 0 || m.Low > m.High {
+		return fmt.Errorf("Watermarks must satisfy 0 < low <= high <= 1, got low=%v high=%v", m.Low, m.High)
+	}
+	return nil
+}
+
+// SetPath changes pool areas, reservations are kept. Space of the pool is
+// checked against the area with least free space, empty areas are ignored.
+func (s *DiskSpace) SetPath(paths ...string) {
+	s.Lock()
+	defer s.Unlock()
+	s.paths = nil
+	for _, path := range paths {
+		if path != "" {
+			s.paths = append(s.paths, path)
+		}
+	}
+	s.full = false
+}
+
+// SetWatermarks replaces watermarks of the pool, zero watermarks keep their current values
+func (s *DiskSpace) SetWatermarks(marks Watermarks) error {
+	s.Lock()
+	defer s.Unlock()
+	if marks.High == 0 {
+		marks.High = s.marks.High
+	}
+	if marks.Low == 0 {
+		marks.Low = s.marks.Low
+	}
+	err := marks.Validate()
+	if err != nil {
+		return err
+	}
+	s.marks = marks
+	return nil
+}
+
+// helper function to sum up reservations, it should be called under lock
+func (s *DiskSpace) sum() int64 {
+	var total int64
+	for _, bytes := range s.reserved {
+		total += bytes
+	}
+	return total
+}
+
+// helper function to find pool area with least free space, it returns empty
+// path if space is not checked
+func (s *DiskSpace) usage() (string, uint64, uint64, error) {
+	var path string
+	var total, free uint64
+	for _, p := range s.paths {
+		t, f, err := utils.DiskUsage(p)
+		if err != nil {
+			return p, 0, 0, err
+		}
+		if path == "" || f < free {
+			path, total, free = p, t, f
+		}
+	}
+	return path, total, free, nil
+}
+
+// helper function to check that given bytes of a transfer identified by given
+// key fit into the pool, current reservation of the key is replaced by the
+// bytes. It updates full state of the pool and should be called under lock.
+func (s *DiskSpace) fit(key string, bytes int64) error {
+	path, total, free, err := s.usage()
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		return nil
+	}
+	reserved := s.sum() - s.reserved[key]
+	if int64(free)-reserved < bytes {
+		return ErrNoSpace
+	}
+	used := float64(total-free) + float64(reserved)
+	if s.full && used < s.marks.Low*float64(total) {
+		s.full = false
+	}
+	if !s.full && used+float64(bytes) > s.marks.High*float64(total) {
+		s.full = true
+	}
+	if s.full {
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// Reserve reserves given bytes for a transfer identified by given key, it
+// replaces previous reservation of the key and returns ErrNoSpace if bytes do
+// not fit into the pool
+func (s *DiskSpace) Reserve(key string, bytes int64) error {
+	s.Lock()
+	defer s.Unlock()
+	err := s.fit(key, bytes)
+	if err != nil {
+		return err
+	}
+	s.reserved[key] = bytes
+	return nil
+}
+
+// Release releases space reserved for a transfer identified by given key
+func (s *DiskSpace) Release(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.reserved, key)
+}
+
+// Check checks that given bytes fit into the pool without reserving them
+func (s *DiskSpace) Check(bytes int64) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.fit("", bytes)
+}
+
+// Status returns space of the pool, full state of the pool is re-evaluated
+// against current free space
+func (s *DiskSpace) Status() SpaceStatus {
+	s.Lock()
+	defer s.Unlock()
+	s.fit("", 0)
+	status := SpaceStatus{Reserved: s.sum(), Watermarks: s.marks, Full: s.full}
+	status.Path, status.Total, status.Free, _ = s.usage()
+	return status
+}
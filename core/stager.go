@@ -4,118 +4,280 @@ package core
 // Author - Valentin Kuznetsov <vkuznet@gmail.com>
 
 import (
-	"bufio"
 	"encoding/hex"
 	"fmt"
 	"hash/adler32"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
 )
 
 // AgentStager represent instance of agent's stager
-var AgentStager *FileSystemStager
+var AgentStager Stager
+
+// stage status of a file
+const (
+	StageOnline  = "online"  // file is in the pool and can be read
+	StageOffline = "offline" // file is known to the catalog and should be staged
+	StageMissing = "missing" // file is unknown to the agent
+)
+
+// StagedFile represents file of the pool opened for reading, it provides
+// random access to serve byte ranges of the file
+type StagedFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// StagingFile represents file which is written into the pool, it becomes
+// visible under its pfn only after Commit. Discard drops uncommitted data.
+type StagingFile interface {
+	io.Writer
+	Path() string
+	Commit() error
+	Discard()
+}
 
 // Stager interface defines abstract functionality of the file stage system
 type Stager interface {
-	Stage(lfn string) error
-	Read(lfn string, chunk int64) ([]byte, error)
-	Write([]byte) (string, int64, string)
-	Exist(lfn string) bool
-	Access(lfn string) string
+	Stage(lfn string) error                 // bring file of given lfn into the pool
+	Status(lfn string) string               // stage status of the file
+	Open(lfn string) (StagedFile, error)    // open file of the pool for reading
+	Create(lfn string) (StagingFile, error) // create file in the pool for writing
+	Remove(lfn string) error                // remove file from the pool
+	Exists(lfn string) bool                 // check if file is in the pool
+	Stat(lfn string) (os.FileInfo, error)   // information about file in the pool
+}
+
+// NewStager returns stager of given kind, empty kind means file system stager
+func NewStager(kind, pool string, catalog Catalog) (Stager, error) {
+	switch kind {
+	case "", "filesystem":
+		return NewFileSystemStager(pool, catalog), nil
+	}
+	return nil, fmt.Errorf("Unknown stager %s", kind)
 }
 
 // FileSystemStager defines simple file-based stager
 type FileSystemStager struct {
-	Pool    string  // pool area on file system
-	Catalog Catalog // TFC catalog of the agent
+	Pool     string  // pool area on file system
+	Catalog  Catalog // TFC catalog of the agent
+	Protocol string  // protocol of trivial file catalog rules which locate files in the pool, default direct
+}
+
+// NewFileSystemStager returns new instance of FileSystemStager type
+func NewFileSystemStager(pool string, catalog Catalog) *FileSystemStager {
+	if pool == "" {
+		pool = "/tmp/transfer2go" // default pool area resides in /tmp
+	}
+	return &FileSystemStager{Pool: pool, Catalog: catalog}
+}
+
+// helper function to get protocol of trivial file catalog rules of the stager
+func (s *FileSystemStager) protocol() string {
+	if s.Protocol == "" {
+		return "direct"
+	}
+	return s.Protocol
+}
+
+// Roots returns areas of the pool, i.e. pool area itself and areas where
+// trivial file catalog rules of the stager protocol place files
+func (s *FileSystemStager) Roots() []string {
+	out := []string{filepath.Clean(s.Pool)}
+	if AgentRules != nil {
+		for _, root := range AgentRules.Roots(s.protocol()) {
+			if !utils.InList(root, out) {
+				out = append(out, root)
+			}
+		}
+	}
+	return out
+}
+
+// helper function to find location of given lfn in the pool, the lfn keeps
+// its directory hierarchy but it can't escape the pool areas. The location
+// is defined by trivial file catalog rules of the stager protocol if agent
+// has them, lfn without matching rule is placed into the pool area.
+func (s *FileSystemStager) path(lfn string) (string, error) {
+	name := cleanLfn(lfn)
+	if name == "/" || strings.ContainsRune(lfn, 0) {
+		return "", fmt.Errorf("Invalid lfn %q", lfn)
+	}
+	fname := filepath.Join(s.Pool, filepath.FromSlash(name))
+	if AgentRules != nil {
+		if pfn, err := AgentRules.Lfn2Pfn(s.protocol(), name); err == nil {
+			fname = filepath.Clean(pfn)
+		}
+	}
+	for _, root := range s.Roots() {
+		if strings.HasPrefix(fname, root+string(filepath.Separator)) {
+			return fname, nil
+		}
+	}
+	return "", fmt.Errorf("Pfn %s of %s is outside of the pool", fname, lfn)
 }
 
 // Stage implements stage functionality of the Stager interface
 // this function takes given lfn and place into internal pool area
 func (s *FileSystemStager) Stage(lfn string) error {
-	fmt.Println("STAGE", lfn)
-	for _, pfn := range s.Catalog.PfnFiles("", "", lfn) {
-		// for simplicity we'll create a soft link to a pfn from a catalog
-		fname := fmt.Sprintf("%s/%s", s.Pool, filepath.Base(lfn))
-		err := os.Symlink(pfn, fname)
-		if err != nil {
-			return err
+	fname, err := s.path(lfn)
+	if err != nil {
+		return err
+	}
+	pfns := s.Catalog.PfnFiles("", "", lfn)
+	if len(pfns) == 0 {
+		return fmt.Errorf("No pfn of %s in the catalog", lfn)
+	}
+	pfn := pfns[0]
+	if info, err := os.Lstat(fname); err == nil {
+		if info.Mode().IsRegular() {
+			return nil // file is already in the pool
 		}
-		logs.WithFields(logs.Fields{
-			"Lfn":  lfn,
-			"Pfn":  pfn,
-			"Pool": s.Pool,
-		}).Info("staged")
+		if target, err := os.Readlink(fname); err == nil && target == pfn {
+			return nil // file is already staged
+		}
+	}
+	// for simplicity we'll create a soft link to a pfn from a catalog, the link
+	// is created under temporary name and replaces existing (stale) link atomically
+	err = os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(fname), fmt.Sprintf(".%s.%d%s", filepath.Base(fname), time.Now().UnixNano(), TempSuffix))
+	err = os.Symlink(pfn, tmp)
+	if err != nil {
+		return err
 	}
+	err = os.Rename(tmp, fname)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	logs.WithFields(logs.Fields{
+		"Lfn":  lfn,
+		"Pfn":  pfn,
+		"Pool": s.Pool,
+	}).Info("staged")
 	return nil
 }
 
-// Access provides access path to the file
-func (s *FileSystemStager) Access(lfn string) string {
-	return fmt.Sprintf("%s/%s", s.Pool, filepath.Base(lfn))
-}
-
-// Read implements read functionality of the Stager interface
-// this function get file associated with lfn from the pool area and return its content
-func (s *FileSystemStager) Read(lfn string, chunk int64) ([]byte, error) {
-	fname := fmt.Sprintf("%s/%s", s.Pool, filepath.Base(lfn))
-	if _, err := os.Stat(fname); !os.IsNotExist(err) {
-		// Define go pipe
-		//         pr, pw := io.Pipe()
-		//         writer := multipart.NewWriter(pw)
-		//         part, err := writer.CreateFormFile("data", fname)
-		//         if err != nil {
-		//             return nil, err
-		//         }
-		// Use copy of writer to avoid deadlock condition
-		//         out := io.MultiWriter(part)
-		//         _, err = io.Copy(out, file)
-		//         if err != nil {
-		//             return nil, err
-		//         }
-		return nil, nil
-	}
-	return nil, nil
-}
-
-// Exist implements exists functionality of the Stager interface
-func (s *FileSystemStager) Exist(lfn string) bool {
-	fname := fmt.Sprintf("%s/%s", s.Pool, filepath.Base(lfn))
-	if _, err := os.Stat(fname); !os.IsNotExist(err) {
-		return true
-	}
-	return false
-}
-
-// Put implements put functionality of the Stager interface
-func (s *FileSystemStager) Write(data []byte, lfn string) (string, int64, string, error) {
-	// create a file (pfn) in local pool
-	pfn := fmt.Sprintf("%s/%s", s.Pool, filepath.Base(lfn))
-	fin, err := os.Create(pfn)
+// Status implements status functionality of the Stager interface
+func (s *FileSystemStager) Status(lfn string) string {
+	if s.Exists(lfn) {
+		return StageOnline
+	}
+	if len(s.Catalog.PfnFiles("", "", lfn)) > 0 {
+		return StageOffline
+	}
+	return StageMissing
+}
+
+// Open implements open functionality of the Stager interface
+func (s *FileSystemStager) Open(lfn string) (StagedFile, error) {
+	fname, err := s.path(lfn)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fname)
+}
+
+// Create implements create functionality of the Stager interface, the data
+// are written into temporary file which is renamed to its pfn on commit
+func (s *FileSystemStager) Create(lfn string) (StagingFile, error) {
+	pfn, err := s.path(lfn)
+	if err != nil {
+		return nil, err
+	}
+	file, err := CreateTempFile(pfn)
 	if err != nil {
 		logs.WithFields(logs.Fields{
 			"Error": err,
 			"Pfn":   pfn,
 		}).Error("Unable to create file in local pool", err)
+		return nil, err
+	}
+	return file, nil
+}
+
+// Remove implements remove functionality of the Stager interface, staged
+// link is removed but not the file it points to
+func (s *FileSystemStager) Remove(lfn string) error {
+	fname, err := s.path(lfn)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fname)
+}
+
+// Exists implements exists functionality of the Stager interface, stale
+// links and directories do not count
+func (s *FileSystemStager) Exists(lfn string) bool {
+	info, err := s.Stat(lfn)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Stat implements stat functionality of the Stager interface, staged links
+// are followed
+func (s *FileSystemStager) Stat(lfn string) (os.FileInfo, error) {
+	fname, err := s.path(lfn)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(fname)
+}
+
+// StoreFile writes data of given reader into the pool of given stager. The
+// data are verified against given size and hash (zero size or empty hash are
+// not checked) before the file becomes visible under its pfn. It returns
+// pfn, size and hash of the stored file.
+func StoreFile(s Stager, lfn string, r io.Reader, size int64, hash string) (string, int64, string, error) {
+	file, err := s.Create(lfn)
+	if err != nil {
 		return "", 0, "", err
 	}
-	// create a hasher to calculate data hash
+	defer file.Discard() // do not leave partial file in a pool
+	// create a hasher to calculate data hash, here is pipe: r->hasher->file
 	hasher := adler32.New()
-	// create our writer with give file descriptor
-	w := bufio.NewWriter(fin)
-	// create multi-writer (data->hasher->writer)
-	mw := io.MultiWriter(hasher, w)
-	// write data through multi-writer (hasher->writer)
-	bytes, err := mw.Write(data)
+	bytes, err := io.Copy(file, io.TeeReader(r, hasher))
 	if err != nil {
 		logs.WithFields(logs.Fields{
+			"Lfn":   lfn,
 			"Error": err,
 		}).Error("Unable to write data through hasher->writer", err)
 		return "", 0, "", err
 	}
-	hash := hex.EncodeToString(hasher.Sum(nil))
-	return pfn, int64(bytes), hash, nil
+	dataHash := hex.EncodeToString(hasher.Sum(nil))
+	if size > 0 && bytes != size {
+		logs.WithFields(logs.Fields{
+			"Lfn":   lfn,
+			"Bytes": bytes,
+			"Size":  size,
+		}).Error("Stager bytes mismatch")
+		return "", 0, "", fmt.Errorf("Size of %s is %d, expected %d", lfn, bytes, size)
+	}
+	if hash != "" && dataHash != hash {
+		logs.WithFields(logs.Fields{
+			"Lfn":         lfn,
+			"Hash":        dataHash,
+			"Source Hash": hash,
+		}).Error("Stager hash mismatch")
+		return "", 0, "", fmt.Errorf("Hash of %s is %s, expected %s", lfn, dataHash, hash)
+	}
+	err = file.Commit()
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Lfn":   lfn,
+			"Error": err,
+		}).Error("Unable to commit file in local pool", err)
+		return "", 0, "", err
+	}
+	return file.Path(), bytes, dataHash, nil
 }
@@ -0,0 +1,111 @@
+package core
+
+// transfer2go atomic writes of incoming files, a file is written under
+// temporary name and renamed to its PFN only after it is verified
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	logs "github.com/sirupsen/logrus"
+)
+
+// TempSuffix is a suffix of temporary files of incoming transfers
+const TempSuffix = ".transfer2go-tmp"
+
+// TempFile represents incoming file which is written under temporary name
+type TempFile struct {
+	*os.File
+	Pfn  string // final name of the file
+	done bool   // indicates that file is either committed or discarded
+}
+
+// CreateTempFile creates temporary file next to given pfn, missing
+// directories of the pfn are created
+func CreateTempFile(pfn string) (*TempFile, error) {
+	err := os.MkdirAll(filepath.Dir(pfn), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(pfn), fmt.Sprintf(".%s.*%s", filepath.Base(pfn), TempSuffix))
+	if err != nil {
+		return nil, err
+	}
+	err = file.Chmod(0644)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &TempFile{File: file, Pfn: pfn}, nil
+}
+
+// Path returns final name of the file
+func (f *TempFile) Path() string {
+	return f.Pfn
+}
+
+// Commit flushes temporary file to disk and atomically renames it to its pfn
+func (f *TempFile) Commit() error {
+	if f.done {
+		return fmt.Errorf("Temporary file of %s is already closed", f.Pfn)
+	}
+	f.done = true
+	err := f.Sync()
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.Pfn)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// make rename durable, failure here does not lose the data
+	if dir, e := os.Open(filepath.Dir(f.Pfn)); e == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Discard closes and removes temporary file unless it is committed, it is
+// safe to call Discard after Commit
+func (f *TempFile) Discard() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// CleanTempFiles removes temporary files left in given pool area, e.g. by
+// agent crash. It should be called before agent accepts transfers.
+func CleanTempFiles(pool string) int {
+	count := 0
+	filepath.Walk(pool, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // skip what we can't read
+		}
+		temporary := info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0
+		if temporary && strings.HasSuffix(info.Name(), TempSuffix) {
+			if e := os.Remove(path); e != nil {
+				logs.WithFields(logs.Fields{
+					"File":  path,
+					"Error": e,
+				}).Warn("Unable to remove temporary file")
+				return nil
+			}
+			count++
+		}
+		return nil
+	})
+	return count
+}
@@ -0,0 +1,211 @@
+package core
+
+// transfer2go trivial file catalog rules, they map logical file names (LFN)
+// into physical file names (PFN) of given protocol and back, see
+// https://twiki.cern.ch/twiki/bin/view/CMSPublic/SWGuideTrivialFileCatalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// maxChain defines maximum depth of chained rules
+const maxChain = 10
+
+// Rule represents lfn-to-pfn or pfn-to-lfn rule of given protocol. The path
+// which matches PathMatch regular expression is replaced by Result where $1, $2,
+// etc. refer to matched groups. If Chain is given the path is mapped by the
+// rules of chained protocol first.
+type Rule struct {
+	Protocol  string `json:"protocol"`  // protocol of the rule, e.g. http, direct, srmv2
+	PathMatch string `json:"pathMatch"` // regular expression of the path
+	Result    string `json:"result"`    // result of the rule
+	Chain     string `json:"chain"`     // protocol of chained rules
+	re        *regexp.Regexp
+}
+
+// Rules represents ordered lfn-to-pfn and pfn-to-lfn rules of the agent, the
+// first matching rule of the protocol is applied
+type Rules struct {
+	LfnRules []Rule `json:"lfn-to-pfn"` // rules to map LFN to PFN
+	PfnRules []Rule `json:"pfn-to-lfn"` // rules to map PFN to LFN
+}
+
+// Mapping represents LFN and its PFN of given protocol
+type Mapping struct {
+	Protocol string `json:"protocol"` // protocol of PFN
+	Lfn      string `json:"lfn"`      // logical file name
+	Pfn      string `json:"pfn"`      // physical file name
+}
+
+// AgentRules holds trivial file catalog rules of the agent, nil rules place
+// LFN into agent backend area
+var AgentRules *Rules
+
+// LoadRules reads trivial file catalog rules from given file, empty file name returns nil rules
+func LoadRules(fname string) (*Rules, error) {
+	if fname == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var r Rules
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return nil, err
+	}
+	err = r.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// helper function to compile regular expressions of the rules
+func (r *Rules) compile() error {
+	for _, rules := range [][]Rule{r.LfnRules, r.PfnRules} {
+		for i := range rules {
+			re, err := regexp.Compile(rules[i].PathMatch)
+			if err != nil {
+				return fmt.Errorf("Invalid path match of %s rule: %v", rules[i].Protocol, err)
+			}
+			rules[i].re = re
+		}
+	}
+	return nil
+}
+
+// helper function to apply rules of given protocol to given path
+func apply(rules []Rule, protocol, name string, depth int) (string, bool) {
+	if depth > maxChain {
+		return "", false
+	}
+	for _, rule := range rules {
+		if rule.Protocol != protocol || rule.re == nil {
+			continue
+		}
+		input := name
+		if rule.Chain != "" {
+			var ok bool
+			input, ok = apply(rules, rule.Chain, name, depth+1)
+			if !ok {
+				continue
+			}
+		}
+		if rule.re.MatchString(input) {
+			return rule.re.ReplaceAllString(input, rule.Result), true
+		}
+	}
+	return "", false
+}
+
+// helper function to clean up lfn, it does not allow to escape LFN namespace
+func cleanLfn(lfn string) string {
+	return path.Clean("/" + lfn)
+}
+
+// Lfn2Pfn maps given lfn to pfn of given protocol
+func (r *Rules) Lfn2Pfn(protocol, lfn string) (string, error) {
+	pfn, ok := apply(r.LfnRules, protocol, cleanLfn(lfn), 0)
+	if !ok {
+		return "", fmt.Errorf("No lfn-to-pfn rule of %s protocol matches %s", protocol, lfn)
+	}
+	return pfn, nil
+}
+
+// Roots returns local areas where lfn-to-pfn rules of given protocol place
+// files, i.e. directories of literal prefixes of the rule results which are
+// absolute paths without parent references. Results of chained rules without
+// prefix use areas of the chain.
+func (r *Rules) Roots(protocol string) []string {
+	return roots(r.LfnRules, protocol, 0)
+}
+
+// helper function to find roots of given protocol rules
+func roots(rules []Rule, protocol string, depth int) []string {
+	var out []string
+	if depth > maxChain {
+		return out
+	}
+	for _, rule := range rules {
+		if rule.Protocol != protocol {
+			continue
+		}
+		var areas []string
+		prefix := strings.SplitN(rule.Result, "$", 2)[0]
+		if prefix == "" && rule.Chain != "" {
+			areas = roots(rules, rule.Chain, depth+1)
+		} else if filepath.IsAbs(prefix) && !strings.Contains(prefix+"/", "/../") {
+			if strings.HasSuffix(prefix, "/") {
+				areas = []string{filepath.Clean(prefix)}
+			} else {
+				areas = []string{filepath.Dir(prefix)}
+			}
+		}
+		for _, area := range areas {
+			if area != "/" && !utils.InList(area, out) {
+				out = append(out, area)
+			}
+		}
+	}
+	return out
+}
+
+// Pfn2Lfn maps given pfn of given protocol to lfn
+func (r *Rules) Pfn2Lfn(protocol, pfn string) (string, error) {
+	lfn, ok := apply(r.PfnRules, protocol, pfn, 0)
+	if !ok {
+		return "", fmt.Errorf("No pfn-to-lfn rule of %s protocol matches %s", protocol, pfn)
+	}
+	return lfn, nil
+}
+
+// Lfn2Pfn maps given lfn to pfn of given protocol with rules of the agent,
+// without rules the lfn is placed into given backend area
+func Lfn2Pfn(protocol, backend, lfn string) (string, error) {
+	if AgentRules == nil {
+		return fmt.Sprintf("%s%s", strings.TrimSuffix(backend, "/"), cleanLfn(lfn)), nil
+	}
+	return AgentRules.Lfn2Pfn(protocol, lfn)
+}
+
+// Pfn2Lfn maps given pfn of given protocol to lfn with rules of the agent,
+// without rules the backend area is stripped from the pfn
+func Pfn2Lfn(protocol, backend, pfn string) (string, error) {
+	if AgentRules == nil {
+		prefix := strings.TrimSuffix(backend, "/")
+		if prefix == "" || !strings.HasPrefix(pfn, prefix+"/") {
+			return "", fmt.Errorf("Pfn %s does not belong to backend %s", pfn, backend)
+		}
+		return strings.TrimPrefix(pfn, prefix), nil
+	}
+	return AgentRules.Pfn2Lfn(protocol, pfn)
+}
+
+// RemotePfn asks given agent to map given lfn to pfn of given protocol
+func RemotePfn(agent, protocol, lfn string) (string, error) {
+	rurl := fmt.Sprintf("%s/lfn2pfn?protocol=%s&lfn=%s", agent, url.QueryEscape(protocol), url.QueryEscape(lfn))
+	resp := utils.FetchResponse(rurl, []byte{})
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Agent %s is unable to map %s, status %d: %s", agent, lfn, resp.StatusCode, strings.TrimSpace(string(resp.Data)))
+	}
+	var m Mapping
+	err := json.Unmarshal(resp.Data, &m)
+	if err != nil {
+		return "", err
+	}
+	return m.Pfn, nil
+}
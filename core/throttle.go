@@ -0,0 +1,261 @@
+package core
+
+// transfer2go throttling of transfers, it limits bandwidth and number of
+// concurrent transfers of the agent and of its links
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTooManyTransfers is returned when transfer exceeds concurrency limit
+var ErrTooManyTransfers = errors.New("Too many concurrent transfers")
+
+// Limit represents bandwidth and concurrency limits of transfers
+type Limit struct {
+	Bandwidth   int64 `json:"bandwidth"`   // bytes per second, zero means unlimited
+	Concurrency int   `json:"concurrency"` // maximum number of concurrent transfers, zero means unlimited
+}
+
+// Limits represents transfer limits of the agent and of its links
+type Limits struct {
+	Agent Limit            `json:"agent"` // limits of all transfers of the agent
+	Links map[string]Limit `json:"links"` // limits of links, the key is src->dst pair of agent aliases, "*" defines default
+}
+
+// ThrottleStatus represents transfer limits along with number of running transfers
+type ThrottleStatus struct {
+	Limits  Limits         `json:"limits"`  // transfer limits
+	Running map[string]int `json:"running"` // number of running transfers of the agent ("agent" key) and of links
+}
+
+// tokenBucket represents token bucket which refills with given rate, it
+// holds tokens worth of one second of transfer
+type tokenBucket struct {
+	rate   float64   // tokens per second
+	tokens float64   // available tokens, negative value is a debt of previous reservations
+	last   time.Time // time of last refill
+}
+
+// reserve takes n tokens from the bucket and returns time to wait until they are available
+func (b *tokenBucket) reserve(n int) time.Duration {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Throttle enforces transfer limits, it is safe for concurrent use
+type Throttle struct {
+	sync.Mutex
+	limits  Limits
+	buckets map[string]*tokenBucket // token buckets of the agent and of links
+	running map[string]int          // number of running transfers of the agent and of links
+	freed   chan struct{}           // closed when one of transfers is finished
+}
+
+// AgentThrottle holds transfer limits of the agent
+var AgentThrottle = NewThrottle()
+
+// key of the agent limits in buckets and running transfers
+const agentKey = "agent"
+
+// NewThrottle returns new instance of Throttle type without limits
+func NewThrottle() *Throttle {
+	return &Throttle{buckets: make(map[string]*tokenBucket), running: make(map[string]int), freed: make(chan struct{})}
+}
+
+// helper function to make a link key
+func linkKey(src, dst string) string {
+	return fmt.Sprintf("%s->%s", src, dst)
+}
+
+// Validate checks that limits are not negative
+func (l Limits) Validate() error {
+	check := func(name string, limit Limit) error {
+		if limit.Bandwidth < 0 || limit.Concurrency < 0 {
+			return fmt.Errorf("Limits of %s must not be negative", name)
+		}
+		return nil
+	}
+	err := check(agentKey, l.Agent)
+	if err != nil {
+		return err
+	}
+	for key, limit := range l.Links {
+		err = check(key, limit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Link returns limits of given link
+func (l Limits) Link(src, dst string) Limit {
+	if limit, ok := l.Links[linkKey(src, dst)]; ok {
+		return limit
+	}
+	return l.Links["*"]
+}
+
+// Set replaces transfer limits, running transfers are not interrupted
+func (th *Throttle) Set(limits Limits) error {
+	err := limits.Validate()
+	if err != nil {
+		return err
+	}
+	th.Lock()
+	defer th.Unlock()
+	th.limits = limits
+	th.buckets = make(map[string]*tokenBucket)
+	th.notify() // transfers waiting for a slot should check new limits
+	return nil
+}
+
+// Status returns transfer limits along with number of running transfers
+func (th *Throttle) Status() ThrottleStatus {
+	th.Lock()
+	defer th.Unlock()
+	running := make(map[string]int)
+	for key, count := range th.running {
+		running[key] = count
+	}
+	return ThrottleStatus{Limits: th.limits, Running: running}
+}
+
+// helper function to wake up transfers waiting for a slot, it should be called under lock
+func (th *Throttle) notify() {
+	close(th.freed)
+	th.freed = make(chan struct{})
+}
+
+// helper function to take transfer slot of the agent and of given link, it should be called under lock
+func (th *Throttle) acquire(src, dst string) (func(), error) {
+	key := linkKey(src, dst)
+	if max := th.limits.Agent.Concurrency; max > 0 && th.running[agentKey] >= max {
+		return nil, ErrTooManyTransfers
+	}
+	if max := th.limits.Link(src, dst).Concurrency; max > 0 && th.running[key] >= max {
+		return nil, ErrTooManyTransfers
+	}
+	th.running[agentKey]++
+	th.running[key]++
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			th.Lock()
+			defer th.Unlock()
+			for _, k := range []string{agentKey, key} {
+				th.running[k]--
+				if th.running[k] <= 0 {
+					delete(th.running, k)
+				}
+			}
+			th.notify()
+		})
+	}
+	return release, nil
+}
+
+// Acquire takes transfer slot of the agent and of given link, it returns
+// ErrTooManyTransfers if concurrency limit is reached. The returned function
+// releases the slot.
+func (th *Throttle) Acquire(src, dst string) (func(), error) {
+	th.Lock()
+	defer th.Unlock()
+	return th.acquire(src, dst)
+}
+
+// Wait waits for transfer slot of the agent and of given link
+func (th *Throttle) Wait(ctx context.Context, src, dst string) (func(), error) {
+	for {
+		th.Lock()
+		release, err := th.acquire(src, dst)
+		freed := th.freed
+		th.Unlock()
+		if err != ErrTooManyTransfers {
+			return release, err
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// helper function to get token bucket of given key and bandwidth, it should be called under lock
+func (th *Throttle) bucket(key string, bandwidth int64) *tokenBucket {
+	if bandwidth <= 0 {
+		return nil
+	}
+	b, ok := th.buckets[key]
+	if !ok || b.rate != float64(bandwidth) {
+		b = &tokenBucket{rate: float64(bandwidth), tokens: float64(bandwidth), last: time.Now()}
+		th.buckets[key] = b
+	}
+	return b
+}
+
+// Consume waits until n bytes may be sent over given link according to
+// bandwidth limits of the agent and of the link
+func (th *Throttle) Consume(ctx context.Context, src, dst string, n int) error {
+	th.Lock()
+	var delay time.Duration
+	for _, b := range []*tokenBucket{th.bucket(agentKey, th.limits.Agent.Bandwidth), th.bucket(linkKey(src, dst), th.limits.Link(src, dst).Bandwidth)} {
+		if b == nil {
+			continue
+		}
+		if d := b.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	th.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads data within bandwidth limits of a link
+type throttledReader struct {
+	ctx      context.Context
+	throttle *Throttle
+	src, dst string
+	reader   io.Reader
+}
+
+// Read implements io.Reader interface
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if e := r.throttle.Consume(r.ctx, r.src, r.dst, n); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+// Reader returns reader which reads given reader within bandwidth limits of given link
+func (th *Throttle) Reader(ctx context.Context, src, dst string, reader io.Reader) io.Reader {
+	return &throttledReader{ctx: ctx, throttle: th, src: src, dst: dst, reader: reader}
+}
@@ -0,0 +1,275 @@
+package core
+
+// transfer2go bearer token (JWT) verification against JSON Web Key Set (JWKS)
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// tokenLeeway defines allowed clock skew in seconds for token time checks
+const tokenLeeway = 60
+
+// keysReload defines minimal interval between reloads of keys triggered by unknown key ids
+const keysReload = 5 * time.Minute
+
+// JWK represents JSON Web Key
+type JWK struct {
+	Kty string `json:"kty"` // key type, RSA or EC
+	Kid string `json:"kid"` // key id
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA exponent
+	Crv string `json:"crv"` // EC curve
+	X   string `json:"x"`   // EC x coordinate
+	Y   string `json:"y"`   // EC y coordinate
+}
+
+// Claims represents claims of the token we use
+type Claims struct {
+	Subject   string      `json:"sub"`    // token subject
+	Issuer    string      `json:"iss"`    // token issuer
+	Audience  interface{} `json:"aud"`    // token audience, either string or list of strings
+	Expires   int64       `json:"exp"`    // expiration time
+	NotBefore int64       `json:"nbf"`    // not before time
+	Scope     string      `json:"scope"`  // space separated list of scopes
+	Groups    []string    `json:"groups"` // user groups
+}
+
+// TokenVerifier verifies bearer tokens issued by trusted issuer
+type TokenVerifier struct {
+	sync.RWMutex
+	Source   string                      // JWKS file name or url
+	Issuer   string                      // expected token issuer
+	Audience string                      // expected token audience
+	keys     map[string]crypto.PublicKey // keys of the issuer
+	loaded   time.Time                   // time of last attempt to load the keys
+}
+
+// AgentTokens holds token verifier of the agent, nil verifier rejects all tokens
+var AgentTokens *TokenVerifier
+
+// NewTokenVerifier returns new instance of TokenVerifier with keys loaded from given source
+func NewTokenVerifier(source, issuer, audience string) (*TokenVerifier, error) {
+	v := &TokenVerifier{Source: source, Issuer: issuer, Audience: audience}
+	err := v.LoadKeys()
+	return v, err
+}
+
+// helper function to decode base64url encoded big integer
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// PublicKey returns public key of JWK
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
+
+// LoadKeys loads keys from JWKS file or url
+func (v *TokenVerifier) LoadKeys() error {
+	v.Lock()
+	v.loaded = time.Now()
+	v.Unlock()
+	var data []byte
+	var err error
+	if strings.HasPrefix(v.Source, "http") {
+		resp := utils.FetchResponse(v.Source, []byte{})
+		data, err = resp.Data, resp.Error
+	} else {
+		data, err = ioutil.ReadFile(v.Source)
+	}
+	if err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	err = json.Unmarshal(data, &jwks)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		key, err := k.PublicKey()
+		if err != nil {
+			return err
+		}
+		keys[k.Kid] = key
+	}
+	v.Lock()
+	defer v.Unlock()
+	v.keys = keys
+	return nil
+}
+
+// helper function to find a key with given id, keys are reloaded if key is
+// unknown but not more often than keysReload interval
+func (v *TokenVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.RLock()
+	key, ok := v.keys[kid]
+	recent := time.Since(v.loaded) < keysReload
+	v.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if recent {
+		return nil, fmt.Errorf("Unknown key %s", kid)
+	}
+	err := v.LoadKeys()
+	if err != nil {
+		return nil, err
+	}
+	v.RLock()
+	defer v.RUnlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown key %s", kid)
+}
+
+// helper function to check if token audience contains given one
+func (c *Claims) hasAudience(aud string) bool {
+	switch v := c.Audience.(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// User returns user represented by the token, token subject is prefixed to
+// not clash with certificate DNs
+func (c *Claims) User() User {
+	return User{Name: tokenPrefix + c.Subject, Groups: c.Groups, Scopes: c.Scopes()}
+}
+
+// Scopes returns list of token scopes
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// Verify verifies signature and claims of given token and returns its claims
+func (v *TokenVerifier) Verify(token string) (*Claims, error) {
+	if v == nil {
+		return nil, errors.New("Token authentication is not configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("Token algorithm does not match the key")
+		}
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig)
+		if err != nil {
+			return nil, err
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return nil, errors.New("Token algorithm does not match the key")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return nil, errors.New("Invalid token signature")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported token algorithm %s", header.Alg)
+	}
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims Claims
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if claims.Expires == 0 || now > claims.Expires+tokenLeeway {
+		return nil, errors.New("Token is expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore-tokenLeeway {
+		return nil, errors.New("Token is not valid yet")
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, fmt.Errorf("Invalid token issuer %s", claims.Issuer)
+	}
+	if v.Audience != "" && !claims.hasAudience(v.Audience) {
+		return nil, errors.New("Invalid token audience")
+	}
+	return &claims, nil
+}
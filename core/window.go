@@ -0,0 +1,136 @@
+package core
+
+// transfer2go transfer windows of the agent and deadlines of transfer requests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+	logs "github.com/sirupsen/logrus"
+)
+
+// Window represents recurring transfer window, it opens according to cron
+// spec and stays open for given duration
+type Window struct {
+	Start    string `json:"start"`    // cron spec of window opening, e.g. "0 22 * * *" or "@daily"
+	Duration string `json:"duration"` // duration of the window, e.g. 6h
+}
+
+// window represents parsed transfer window
+type window struct {
+	schedule cron.Schedule
+	duration time.Duration
+}
+
+// TransferWindows holds transfer windows of the agent, transfers are allowed
+// when any of the windows is open. No windows means that transfers are always
+// allowed. TransferWindows is safe for concurrent use.
+type TransferWindows struct {
+	sync.RWMutex
+	specs   []Window
+	windows []window
+}
+
+// AgentWindows holds transfer windows of the agent
+var AgentWindows = &TransferWindows{}
+
+// Set replaces transfer windows
+func (tw *TransferWindows) Set(specs []Window) error {
+	var windows []window
+	for _, spec := range specs {
+		schedule, err := cron.ParseStandard(spec.Start)
+		if err != nil {
+			return fmt.Errorf("Invalid start of transfer window %s: %v", spec.Start, err)
+		}
+		// schedule returns zero time when it does not match any time
+		if schedule.Next(time.Now()).IsZero() {
+			return fmt.Errorf("Transfer window %s never opens", spec.Start)
+		}
+		duration, err := time.ParseDuration(spec.Duration)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid duration of transfer window %s", spec.Duration)
+		}
+		windows = append(windows, window{schedule: schedule, duration: duration})
+	}
+	tw.Lock()
+	defer tw.Unlock()
+	tw.specs = specs
+	tw.windows = windows
+	return nil
+}
+
+// Get returns transfer windows
+func (tw *TransferWindows) Get() []Window {
+	tw.RLock()
+	defer tw.RUnlock()
+	return tw.specs
+}
+
+// Open checks if transfers are allowed at given time
+func (tw *TransferWindows) Open(t time.Time) bool {
+	tw.RLock()
+	defer tw.RUnlock()
+	if len(tw.windows) == 0 {
+		return true
+	}
+	for _, w := range tw.windows {
+		// window is open if it was opened within its duration before given time
+		if !w.schedule.Next(t.Add(-w.duration)).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns time at or after given time when transfers are allowed
+func (tw *TransferWindows) Next(t time.Time) time.Time {
+	if tw.Open(t) {
+		return t
+	}
+	tw.RLock()
+	defer tw.RUnlock()
+	var next time.Time
+	for _, w := range tw.windows {
+		if n := w.schedule.Next(t); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	return next
+}
+
+// helper function to expire pending requests which missed their deadline, it
+// runs periodically until given context is done
+func expireRequests(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			requests, err := TFC.ListRequest("pending")
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Error": err,
+				}).Error("Unable to list pending requests")
+				continue
+			}
+			for _, t := range requests {
+				if !t.Expired() {
+					continue
+				}
+				RequestQueueLock.Lock()
+				RequestQueue.Delete(t.Id)
+				RequestQueueLock.Unlock()
+				err = TFC.UpdateRequest(t.Id, "expired")
+				logs.WithFields(logs.Fields{
+					"Request": t.String(),
+					"Error":   err,
+				}).Warn("Pending request is expired")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
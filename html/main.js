@@ -34,15 +34,18 @@ $(document).ready(function () {
 		$('table tr').each(function() {
     	var id = $(this).find(".id").html();
 			var action = $(this).find(".action").val();
+			var comment = $(this).find(".comment").val();
 			console.log("action" + action)
 			if(action=="transfer"){
 				actionArr.push({
           				action: "approve", 
+          				comment: comment,
           				request: {id: id}
         			});
-			}else if(action=="delete"){
+			}else if(action=="reject" || action=="delete" || action=="cancel" || action=="retry"){
 				actionArr.push({
           action: action,
+          comment: comment,
           request: {id: id}
         });
 			}else{
@@ -63,6 +66,10 @@ $(document).ready(function () {
 });
 
 function renderRequest(type) {
+	if(type=="pending") {
+		renderApprovals();
+		return;
+	}
 	client.get('http://' + window.location.host + '/list?type=' + type, function(response) {
 		var tRequests = JSON.parse(response);
 		$('.table tr').css('display', 'none');
@@ -78,7 +85,7 @@ function renderRequest(type) {
 			html += '<span></span>'
 			html += '</nav>';
 			html += '<nav class="navbar navbar-right">'
-			html += '<select class="action"> <option value="none">None</option> <option value="delete">delete</option> <option value="transfer">transfer</option> </select>';
+			html += '<select class="action"> <option value="none">None</option> <option value="delete">delete</option> <option value="transfer">transfer</option> <option value="cancel">cancel</option> <option value="retry">retry</option> </select>';
 			html += '</nav>'
 			html += '</div>';
 			html += '<b>Source:</b> '+tRequests[index].srcUrl+'&nbsp;<br>';
@@ -86,6 +93,50 @@ function renderRequest(type) {
 			html += '<b>Block:</b> '+tRequests[index].block+'&nbsp;<br>';
 			html += '<b>Dataset:</b> '+tRequests[index].dataset+'&nbsp;<br>';
 			html += '<b>File:</b> '+tRequests[index].file;
+			var progress = tRequests[index].progress;
+			if(progress) {
+				html += '<br><b>Progress:</b> '+progress.done+'/'+progress.total+' files done, '+progress.failed+' failed, '+progress.cancelled+' cancelled, '+progress.expired+' expired, '+progress.bytesDone+'/'+progress.bytes+' bytes';
+			}
+			html += '<hr/></div>'
+			tRow = $('<tr>');
+			tRow.append(html)
+			$('table').append(tRow);
+		});
+	});
+}
+
+// pending requests are shown along with their approvals and missing roles
+function renderApprovals() {
+	client.get('http://' + window.location.host + '/approvals', function(response) {
+		var pApprovals = JSON.parse(response) || [];
+		$('.table tr').css('display', 'none');
+		$('.table tr').remove()
+		$.each(pApprovals, function(index) {
+			var req = pApprovals[index].request;
+			var html = '<div class="reqdiv" id="div-request-'+req.id+'">';
+			html += '<b>Request:</b> <span class="id">'+req.id+'</span>&nbsp;';
+			html += '<b>Status:</b> <span style="color:'+genColor(req.id)+';background-color:#fff;padding:3px;">'+req.status+'</span>&nbsp;';
+			html += '<b>Priority:</b> '+req.priority+'&nbsp;';
+			html += '<div class="lift">'
+			html += '<nav class="navbar navbar-left">';
+			html += '<span></span>'
+			html += '</nav>';
+			html += '<nav class="navbar navbar-right">'
+			html += '<input class="comment" type="text" placeholder="comment"/> ';
+			html += '<select class="action"> <option value="none">None</option> <option value="delete">delete</option> <option value="reject">reject</option> <option value="transfer">approve</option> </select>';
+			html += '</nav>'
+			html += '</div>';
+			html += '<b>User:</b> '+req.user+'&nbsp;<br>';
+			html += '<b>Source:</b> '+req.srcUrl+'&nbsp;<br>';
+			html += '<b>Dest:</b> '+req.dstUrl+'&nbsp;<br>';
+			html += '<b>Bytes:</b> '+req.bytes+'&nbsp;<br>';
+			html += '<b>Block:</b> '+req.block+'&nbsp;<br>';
+			html += '<b>Dataset:</b> '+req.dataset+'&nbsp;<br>';
+			html += '<b>File:</b> '+req.file+'&nbsp;<br>';
+			html += '<b>Missing approvals:</b> '+(pApprovals[index].missing || []).join(', ')+'&nbsp;<br>';
+			$.each(pApprovals[index].approvals || [], function(i, a) {
+				html += '<b>'+a.decision+':</b> '+a.user+' ('+(a.roles || []).join(', ')+') '+a.comment+'<br>';
+			});
 			html += '<hr/></div>'
 			tRow = $('<tr>');
 			tRow.append(html)
@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -40,14 +41,28 @@ func main() {
 	flag.StringVar(&action, "action", "", "Specify action JSON to process [CLIENT]")
 	var register string
 	flag.StringVar(&register, "register", "", "File with meta-data of records in JSON data format to register at remote agent [CLIENT]")
-	var approve int64
-	flag.Int64Var(&approve, "approve", 0, "Approve given request id to initiate the transfer [CLIENT]")
+	var approve string
+	flag.StringVar(&approve, "approve", "", "Approve given request id to initiate the transfer [CLIENT]")
+	var reject string
+	flag.StringVar(&reject, "reject", "", "Reject given request id [CLIENT]")
+	var comment string
+	flag.StringVar(&comment, "comment", "", "Comment of approval or rejection [CLIENT]")
+	var approvals bool
+	flag.BoolVar(&approvals, "approvals", false, "Show pending requests along with their approvals [CLIENT]")
 	//     var model string
 	//     flag.StringVar(&model, "model", "pull", "Transfer model: pull (data transfer through main agent), push (data transfer from src to dst directly) [CLIENT]")
 	var requests string
 	flag.StringVar(&requests, "requests", "", "Show given type of requests (pending, transfer) [CLIENT]")
+	var group string
+	flag.StringVar(&group, "group", "", "Show requests derived from given parent request [CLIENT]")
+	flag.StringVar(&client.NotBefore, "notbefore", "", "Do not transfer data before given time (RFC3339) or duration from now, e.g. 2h [CLIENT]")
+	flag.StringVar(&client.Deadline, "deadline", "", "Expire transfer request if data are not transferred by given time (RFC3339) or duration from now [CLIENT]")
 
 	flag.BoolVar(&utils.Auth, "auth", true, "To disable the auth layer [SERVER|CLIENT]")
+	var token string
+	flag.StringVar(&token, "token", "", "Bearer token or file with the token, by default TRANSFER2GO_TOKEN or TRANSFER2GO_TOKEN_FILE environment is used [SERVER|CLIENT]")
+	var tokenHosts string
+	flag.StringVar(&tokenHosts, "tokenHosts", "", "Comma separated list of hosts which receive bearer token in addition to agent host [SERVER|CLIENT]")
 
 	flag.Usage = func() {
 		fmt.Println(fmt.Sprintf("Usage of %s", os.Args[0]))
@@ -63,9 +78,30 @@ func main() {
 		os.Exit(0)
 
 	}
-	if utils.Auth {
+	var err error
+	utils.Token, err = utils.ReadToken(token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Token": token,
+			"Error": err,
+		}).Fatal("Unable to read token")
+	}
+	if utils.Auth && utils.Token == "" {
 		utils.CheckX509()
 	}
+	if tokenHosts != "" {
+		utils.AddTokenHosts(strings.Split(tokenHosts, ",")...)
+	}
+	if agent != "" {
+		utils.AddTokenHosts(agent)
+	}
+	err = utils.LoadCACerts(os.Getenv("X509_CERT_DIR"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"X509_CERT_DIR": os.Getenv("X509_CERT_DIR"),
+			"Error":         err,
+		}).Fatal("Unable to load CA certificates")
+	}
 
 	utils.VERBOSE = verbose
 	if configFile != "" {
@@ -111,7 +147,7 @@ func main() {
 			log.Warn("WARNING this agent is not registered with remote ones, either provide register in your config or invoke register API call")
 		}
 
-		server.Init()
+		server.Version = "{{VERSION}}"
 		server.Server(config)
 	} else {
 		if register != "" { // register data in agent
@@ -119,6 +155,14 @@ func main() {
 		} else if action != "" { // perform action on main agent
 			client.ProcessAction(agent, action)
 			//             core.AuthzDecorator(client.ProcessAction, "admin")(agent, action)
+		} else if approve != "" { // approve request on main agent
+			client.SendAction(agent, client.ActionRequest{Id: approve, Action: "approve", Comment: comment})
+		} else if reject != "" { // reject request on main agent
+			client.SendAction(agent, client.ActionRequest{Id: reject, Action: "reject", Comment: comment})
+		} else if approvals { // show pending approvals from the agent
+			client.ShowApprovals(agent)
+		} else if group != "" { // show requests of request group from the agent
+			client.ShowGroup(agent, group)
 		} else if requests != "" { // show requests from the agent
 			client.ShowRequests(agent, requests)
 		} else if src == "" { // no transfer request
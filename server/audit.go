@@ -0,0 +1,146 @@
+package server
+
+// transfer2go audit of state-changing operations of the agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// auditKey is a context key of audit record of HTTP request
+type auditKey struct{}
+
+// statusWriter keeps track of HTTP status code written by handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter interface
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// unauditedEndpoints lists endpoints which accept POST requests without changing
+// state of the agent: periodic agent protocol exchanges and read-only lookups
+var unauditedEndpoints = []string{"gossip", "records"}
+
+// helper function to check if HTTP request may change state of the agent
+func stateChanging(r *http.Request, endpoint string) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return false
+	}
+	return !utils.InList(endpoint, unauditedEndpoints)
+}
+
+// helper function to write audit record of HTTP request with given outcome
+func audit(r *http.Request, rec *core.AuditRecord, status int) {
+	rec.Status = status
+	if rec.Outcome == "" {
+		rec.Outcome = core.AuditSuccess
+		if status >= 400 {
+			rec.Outcome = core.AuditFailure
+		}
+	}
+	if rec.Action == "" {
+		rec.Action = rec.Endpoint
+	}
+	err := core.AgentAudit.Record(*rec)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Record": rec.String(),
+			"Error":  err,
+		}).Error("Unable to write audit record")
+	}
+}
+
+// helper function to create audit record of HTTP request
+func auditRecord(r *http.Request, user core.User, endpoint string) *core.AuditRecord {
+	return &core.AuditRecord{TimeStamp: time.Now().Unix(), User: user.Name, Agent: _alias, Endpoint: endpoint, Method: r.Method}
+}
+
+// helper function to record denied HTTP request
+func auditDenied(r *http.Request, user core.User, endpoint string, status int) {
+	if !stateChanging(r, endpoint) {
+		return
+	}
+	rec := auditRecord(r, user, endpoint)
+	rec.Outcome = core.AuditDenied
+	audit(r, rec, status)
+}
+
+// helper function to add action and request ids to audit record of HTTP request
+func auditAction(r *http.Request, action string, ids ...string) {
+	rec, ok := r.Context().Value(auditKey{}).(*core.AuditRecord)
+	if !ok {
+		return
+	}
+	if action != "" && !utils.InList(action, strings.Split(rec.Action, ",")) {
+		if rec.Action != "" {
+			action = rec.Action + "," + action
+		}
+		rec.Action = action
+	}
+	rec.Requests = append(rec.Requests, ids...)
+}
+
+// helper function to call given handler and record its outcome in audit log
+func audited(w http.ResponseWriter, r *http.Request, endpoint string, handler http.HandlerFunc) {
+	if !stateChanging(r, endpoint) {
+		handler(w, r)
+		return
+	}
+	rec := auditRecord(r, requestUser(r), endpoint)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	handler(sw, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+	audit(r, rec, sw.status)
+}
+
+// AuditHandler provides audit records, they can be selected by since (time stamp
+// or duration, e.g. 24h), user and action parameters
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var since int64
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+				return
+			}
+			since = time.Now().Add(-d).Unix()
+		}
+	}
+	records, err := core.TFC.Audit(since, r.FormValue("user"), r.FormValue("action"))
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("AuditHandler unable to get audit records")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("AuditHandler unable to marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,289 @@
+package server
+
+// transfer2go gossip based agent membership. Every agent periodically exchanges
+// its membership view with few random agents (push-pull anti-entropy), such that
+// all agents converge on the same view without full-mesh registration.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Member represents versioned membership entry of the agent. The version is
+// defined by incarnation and heartbeat counters which are only incremented by
+// agent itself, therefore newer entry always supersedes an older one.
+type Member struct {
+	Alias        string   `json:"alias"`        // agent name
+	Url          string   `json:"url"`          // agent url
+	Protocol     string   `json:"protocol"`     // agent transfer protocol
+	Backend      string   `json:"backend"`      // agent storage backend
+	Capabilities []string `json:"capabilities"` // agent capabilities
+	Version      string   `json:"version"`      // agent version
+	Incarnation  int64    `json:"incarnation"`  // agent incarnation, it is changed when agent (re)starts or refutes suspicion
+	Heartbeat    int64    `json:"heartbeat"`    // agent heartbeat counter
+	State        string   `json:"state"`        // agent state: alive, suspect or dead
+}
+
+// Membership represents membership view of the agent. Dead members are kept
+// to spread the news of their death and they are reaped afterwards.
+type Membership struct {
+	sync.RWMutex
+	Self    string               // alias of the agent which owns this view
+	Members map[string]Member    // agent alias and its membership entry
+	dead    map[string]time.Time // agent alias and time we learned about its death
+}
+
+// global membership view of the agent
+var _members = NewMembership("")
+
+// NewMembership returns new instance of Membership type
+func NewMembership(self string) *Membership {
+	return &Membership{Self: self, Members: make(map[string]Member), dead: make(map[string]time.Time)}
+}
+
+// String provides string representation of membership entry
+func (m *Member) String() string {
+	return fmt.Sprintf("<Member alias=%s url=%s incarnation=%d heartbeat=%d state=%s>", m.Alias, m.Url, m.Incarnation, m.Heartbeat, m.State)
+}
+
+// helper function to order agent states, dead state overrides suspect and alive
+// ones for the same version of membership entry
+func stateRank(state string) int {
+	switch state {
+	case core.AgentSuspect:
+		return 1
+	case core.AgentDead:
+		return 2
+	}
+	return 0
+}
+
+// Newer checks if membership entry is newer than given one
+func (m *Member) Newer(o Member) bool {
+	if m.Incarnation != o.Incarnation {
+		return m.Incarnation > o.Incarnation
+	}
+	if m.Heartbeat != o.Heartbeat {
+		return m.Heartbeat > o.Heartbeat
+	}
+	return stateRank(m.State) > stateRank(o.State)
+}
+
+// Join adds itself into membership view
+func (ms *Membership) Join(self Member) {
+	ms.Lock()
+	defer ms.Unlock()
+	self.Incarnation = time.Now().UnixNano()
+	self.State = core.AgentAlive
+	ms.Self = self.Alias
+	ms.Members[self.Alias] = self
+}
+
+// Add adds agent into membership view unless it is already known
+func (ms *Membership) Add(alias, aurl string) {
+	ms.Lock()
+	defer ms.Unlock()
+	if m, ok := ms.Members[alias]; ok && m.Url == aurl {
+		return
+	}
+	ms.Members[alias] = Member{Alias: alias, Url: aurl, State: core.AgentAlive}
+}
+
+// Beat increments heartbeat counter of the agent itself
+func (ms *Membership) Beat() {
+	ms.Lock()
+	defer ms.Unlock()
+	m := ms.Members[ms.Self]
+	m.Heartbeat++
+	ms.Members[ms.Self] = m
+}
+
+// SetState changes state of given agent in membership view
+func (ms *Membership) SetState(alias, state string) {
+	ms.Lock()
+	defer ms.Unlock()
+	if m, ok := ms.Members[alias]; ok && alias != ms.Self {
+		m.State = state
+		ms.put(m)
+	}
+}
+
+// helper function to put entry into membership view and keep track of dead
+// members, it should be called under lock
+func (ms *Membership) put(m Member) {
+	ms.Members[m.Alias] = m
+	if m.State != core.AgentDead {
+		delete(ms.dead, m.Alias)
+	} else if _, ok := ms.dead[m.Alias]; !ok {
+		ms.dead[m.Alias] = time.Now()
+	}
+}
+
+// Reap removes members which are dead longer than given timeout and returns them
+func (ms *Membership) Reap(timeout time.Duration) []Member {
+	ms.Lock()
+	defer ms.Unlock()
+	var reaped []Member
+	for alias, since := range ms.dead {
+		if time.Since(since) < timeout {
+			continue
+		}
+		reaped = append(reaped, ms.Members[alias])
+		delete(ms.Members, alias)
+		delete(ms.dead, alias)
+	}
+	return reaped
+}
+
+// Merge merges given membership entries into the view and returns list of
+// agents whose entries have been updated. If other agents suspect this agent
+// it refutes suspicion by incrementing its incarnation.
+func (ms *Membership) Merge(members []Member) []Member {
+	ms.Lock()
+	defer ms.Unlock()
+	var updated []Member
+	for _, m := range members {
+		if m.Alias == ms.Self {
+			self := ms.Members[ms.Self]
+			if m.State != core.AgentAlive && m.Incarnation >= self.Incarnation {
+				self.Incarnation = m.Incarnation + 1
+				ms.Members[ms.Self] = self
+			}
+			continue
+		}
+		prev, ok := ms.Members[m.Alias]
+		if ok && !m.Newer(prev) {
+			continue
+		}
+		if !ok && m.State == core.AgentDead {
+			continue // we don't learn about dead agents, e.g. the ones we already reaped
+		}
+		ms.put(m)
+		updated = append(updated, m)
+	}
+	return updated
+}
+
+// List returns all membership entries
+func (ms *Membership) List() []Member {
+	ms.RLock()
+	defer ms.RUnlock()
+	var out []Member
+	for _, m := range ms.Members {
+		out = append(out, m)
+	}
+	return out
+}
+
+// Peers returns up to n random agents which are not known to be dead
+func (ms *Membership) Peers(n int) []Member {
+	var peers []Member
+	for _, m := range ms.List() {
+		if m.Alias != ms.Self && m.State != core.AgentDead {
+			peers = append(peers, m)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// helper function to apply updated membership entries to agent registry
+func applyMembers(members []Member) {
+	for _, m := range members {
+		if m.State == core.AgentDead {
+			if core.Agents.Deregister(m.Alias, m.Url) {
+				logs.WithFields(logs.Fields{
+					"Member": m.String(),
+				}).Warn("Agent is dead, deregister it")
+			}
+			continue
+		}
+		core.Agents.Register(core.AgentRecord{Alias: m.Alias, Url: m.Url, Protocol: m.Protocol, Backend: m.Backend, Capabilities: m.Capabilities, Version: m.Version})
+	}
+}
+
+// helper function to fetch membership view of given agent, given data are
+// posted to the agent (POST) when provided
+func fetchMembers(aurl string, data []byte) ([]Member, error) {
+	var members []Member
+	resp := utils.FetchResponse(fmt.Sprintf("%s/gossip", aurl), data)
+	if resp.Error != nil {
+		return members, resp.Error
+	}
+	if resp.StatusCode != http.StatusOK {
+		return members, fmt.Errorf("Response %s, error=%s", resp.Status, string(resp.Data))
+	}
+	err := json.Unmarshal(resp.Data, &members)
+	return members, err
+}
+
+// helper function to exchange membership view with given agent
+func exchange(aurl string) error {
+	data, err := json.Marshal(_members.List())
+	if err != nil {
+		return err
+	}
+	members, err := fetchMembers(aurl, data)
+	if err != nil {
+		return err
+	}
+	applyMembers(_members.Merge(members))
+	return nil
+}
+
+// helper function to perform single gossip round with given number of random agents
+func gossipRound(fanout int) {
+	_members.Beat()
+	for _, m := range _members.Peers(fanout) {
+		err := exchange(m.Url)
+		if err != nil && utils.VERBOSE > 0 {
+			logs.WithFields(logs.Fields{
+				"Member": m.String(),
+				"Error":  err,
+			}).Warn("Unable to gossip")
+		}
+	}
+}
+
+// GossipHandler merges membership view of another agent (POST) and returns
+// membership view of this agent
+func GossipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var members []Member
+		err := json.NewDecoder(r.Body).Decode(&members)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error": err,
+			}).Error("GossipHandler unable to decode")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		applyMembers(_members.Merge(members))
+	}
+	data, err := json.Marshal(_members.List())
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("GossipHandler unable to marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -4,6 +4,8 @@ package server
 // Author: Valentin Kuznetsov <vkuznet@gmail.com>
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -16,6 +18,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	logs "github.com/sirupsen/logrus"
@@ -23,95 +26,248 @@ import (
 	"github.com/vkuznet/transfer2go/utils"
 )
 
-// global variable which we initialize once
-var _userDNs []string
+// userKey is a context key of authenticated user
+type userKey struct{}
 
-func userDNs() []string {
-	var out []string
-	rurl := "https://cmsweb.cern.ch/sitedb/data/prod/people"
-	resp := utils.FetchResponse(rurl, []byte{})
-	if resp.Error != nil {
+// custom logic for authentication, the user either provides bearer token issued
+// by trusted issuer or X509 certificate whose DN is known to identity provider
+func auth(r *http.Request) (core.User, bool) {
+
+	if !utils.Auth {
+		return core.User{}, true
+	}
+
+	if utils.VERBOSE > 1 {
+		dump, err := httputil.DumpRequest(r, true)
 		logs.WithFields(logs.Fields{
-			"Error": resp.Error,
-		}).Error("Unable to fetch SiteDB records", resp.Error)
-		return out
+			"Request": r,
+			"Dump":    string(dump),
+			"Error":   err,
+		}).Println("AuthHandler HTTP request")
 	}
-	var rec map[string]interface{}
-	err := json.Unmarshal(resp.Data, &rec)
-	if err != nil {
+	if token := utils.BearerToken(r); token != "" {
+		claims, err := core.AgentTokens.Verify(token)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error": err,
+			}).Error("Auth unable to verify bearer token")
+			return core.User{}, false
+		}
+		return claims.User(), true
+	}
+	userDN := utils.UserDN(r)
+	if mutualTLS() {
+		cert, err := utils.PeerCertificate(r)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"User DN": userDN,
+				"Error":   err,
+			}).Error("Auth unable to verify client certificate")
+			return core.User{}, false
+		}
+		if host := agentHost(cert); host != "" {
+			return core.User{Name: userDN, Agent: host}, true
+		}
+	}
+	match := userDN != "" && core.AgentIdentities.Known(userDN)
+	if !match {
 		logs.WithFields(logs.Fields{
-			"Error": err,
-		}).Error("Unable to unmarshal response", err)
-		return out
-	}
-	desc := rec["desc"].(map[string]interface{})
-	headers := desc["columns"].([]interface{})
-	var idx int
-	for i, h := range headers {
-		if h.(string) == "dn" {
-			idx = i
-			break
+			"User DN": userDN,
+		}).Error("Auth userDN not found in identity provider")
+	}
+	return core.User{Name: userDN}, match
+}
+
+// helper function to check if agent verifies client certificates against trusted CAs
+func mutualTLS() bool {
+	return utils.Auth && utils.CACerts != nil
+}
+
+// helper function to get host name of the agent from verified certificate, the
+// agent (host) certificates carry DNS names and can be used by TLS servers
+func agentHost(cert *x509.Certificate) string {
+	if len(cert.DNSNames) == 0 {
+		return ""
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageServerAuth {
+			return cert.DNSNames[0]
 		}
 	}
-	values := rec["result"].([]interface{})
-	for _, item := range values {
-		val := item.([]interface{})
-		v := val[idx]
-		if v != nil {
-			out = append(out, v.(string))
+	return ""
+}
+
+// helper function to check that agent certificate of HTTP request is valid for
+// host of given agent url
+func agentMatches(r *http.Request, aurl string) bool {
+	if !mutualTLS() {
+		return true
+	}
+	cert, err := utils.PeerCertificate(r)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(aurl)
+	if err != nil {
+		return false
+	}
+	return cert.VerifyHostname(u.Hostname()) == nil
+}
+
+// helper function to check that agent certificate of HTTP request is bound to
+// registered agent with given alias, empty alias matches any registered agent
+func boundAgent(r *http.Request, alias string) bool {
+	if !mutualTLS() {
+		return true
+	}
+	for _, rec := range core.Agents.List() {
+		if rec.State == core.AgentDead || (alias != "" && rec.Alias != alias) {
+			continue
+		}
+		if agentMatches(r, rec.Url) {
+			return true
 		}
 	}
-	return out
+	logs.WithFields(logs.Fields{
+		"User":  requestUser(r).Name,
+		"Agent": requestUser(r).Agent,
+		"Alias": alias,
+	}).Warn("Agent certificate is not bound to registered agent")
+	return false
 }
 
-// func init() {
-//	_userDNs = userDNs()
-//}
+// helper function to find alias of registered agent bound to agent certificate
+// of HTTP request, given alias is preferred when several agents share the host
+func certAgent(r *http.Request, alias string) string {
+	var found string
+	for _, rec := range core.Agents.List() {
+		if rec.State == core.AgentDead || !agentMatches(r, rec.Url) {
+			continue
+		}
+		if rec.Alias == alias {
+			return alias
+		}
+		if found == "" || rec.Alias < found {
+			found = rec.Alias
+		}
+	}
+	return found
+}
 
-// Init is custom initialization function, we don't use init() because we want
-// control of authentication from command line
-func Init() {
-	if utils.Auth {
-		_userDNs = userDNs()
+// helper function to identify recipient of a download, agents are identified
+// by their certificates and other users by their names. Without authentication
+// the recipient is trusted to tell its alias.
+func downloadPeer(r *http.Request) string {
+	dst := r.URL.Query().Get("dst")
+	if !utils.Auth {
+		return dst
+	}
+	user := requestUser(r)
+	if mutualTLS() && user.Agent != "" {
+		if alias := certAgent(r, dst); alias != "" {
+			return alias
+		}
+		return user.Agent
 	}
+	return user.Name
 }
 
-// custom logic for CMS authentication, users may implement their own logic here
-func auth(r *http.Request) bool {
+// helper function to get authenticated user of HTTP request
+func requestUser(r *http.Request) core.User {
+	if u, ok := r.Context().Value(userKey{}).(core.User); ok {
+		return u
+	}
+	return core.User{}
+}
 
+// helper function to check if user is authorized to access given endpoint
+func authorized(r *http.Request, endpoint string) bool {
 	if !utils.Auth {
 		return true
 	}
-
-	if utils.VERBOSE > 1 {
-		dump, err := httputil.DumpRequest(r, true)
+	user := requestUser(r)
+	if mutualTLS() && core.AgentEndpoint(r.Method, endpoint) && user.Agent == "" {
 		logs.WithFields(logs.Fields{
-			"Request": r,
-			"Dump":    string(dump),
-			"Error":   err,
-		}).Println("AuthHandler HTTP request")
+			"User":     user.Name,
+			"Endpoint": endpoint,
+		}).Warn("Agent certificate is required")
+		return false
 	}
-	userDN := utils.UserDN(r)
-	match := utils.InList(userDN, _userDNs)
-	if !match {
+	// agents register themselves via register endpoint, other agent endpoints
+	// are used by registered agents only
+	if mutualTLS() && core.AgentEndpoint(r.Method, endpoint) && endpoint != "register" && !boundAgent(r, "") {
+		return false
+	}
+	return core.AgentPolicy.Endpoint(user, r.Method, endpoint)
+}
+
+// helper function to check if user is authorized to perform given request action
+func authorizedAction(r *http.Request, action string) bool {
+	if !utils.Auth {
+		return true
+	}
+	user := requestUser(r)
+	if mutualTLS() && utils.InList(action, core.AgentActions) && user.Agent == "" {
 		logs.WithFields(logs.Fields{
-			"User DN": userDN,
-		}).Error("Auth userDN not found in SiteDB")
+			"User":   user.Name,
+			"Action": action,
+		}).Warn("Agent certificate is required")
+		return false
+	}
+	if mutualTLS() && utils.InList(action, core.AgentActions) && !boundAgent(r, "") {
+		return false
+	}
+	return core.AgentPolicy.Action(user, action)
+}
+
+// helper function to submit jobs to given queue, it replies with 429 status
+// when queue is saturated and returns false if jobs were not submitted
+func submitJobs(w http.ResponseWriter, queue *core.JobQueue, jobs []core.Job) bool {
+	if len(jobs) == 0 {
+		return true
 	}
-	return match
+	err := queue.Submit(jobs...)
+	if err == core.ErrQueueFull {
+		ready, delayed := queue.Len()
+		logs.WithFields(logs.Fields{
+			"Jobs":     len(jobs),
+			"Ready":    ready,
+			"Delayed":  delayed,
+			"Capacity": queue.Capacity,
+		}).Warn("Queue is saturated, reject jobs")
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return false
+	}
+	return true
 }
 
 // AuthHandler authenticate incoming requests and route them to appropriate handler
 func AuthHandler(w http.ResponseWriter, r *http.Request) {
+	arr := strings.Split(r.URL.Path, "/")
+	path := arr[len(arr)-1]
 	// check if server started with hkey file (auth is required)
-	status := auth(r)
+	user, status := auth(r)
 	if !status {
+		auditDenied(r, user, path, http.StatusForbidden)
 		msg := "You are not allowed to access this resource"
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
-	arr := strings.Split(r.URL.Path, "/")
-	path := arr[len(arr)-1]
+	r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+	if !authorized(r, path) {
+		auditDenied(r, user, path, http.StatusForbidden)
+		msg := "You are not authorized to access this resource"
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+	audited(w, r, path, func(w http.ResponseWriter, r *http.Request) {
+		route(w, r, path)
+	})
+}
+
+// helper function to route request to appropriate handler
+func route(w http.ResponseWriter, r *http.Request, path string) {
 	switch path {
 	case "status":
 		StatusHandler(w, r)
@@ -151,6 +307,28 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 		PushHandler(w, r)
 	case "history":
 		HistoricalHandler(w, r)
+	case "heartbeat":
+		HeartbeatHandler(w, r)
+	case "gossip":
+		GossipHandler(w, r)
+	case "links":
+		LinksHandler(w, r)
+	case "probe":
+		ProbeHandler(w, r)
+	case "identities":
+		IdentitiesHandler(w, r)
+	case "audit":
+		AuditHandler(w, r)
+	case "quota":
+		QuotaHandler(w, r)
+	case "approvals":
+		ApprovalsHandler(w, r)
+	case "shares":
+		SharesHandler(w, r)
+	case "limits":
+		LimitsHandler(w, r)
+	case "lfn2pfn":
+		Lfn2PfnHandler(w, r)
 	default:
 		DefaultHandler(w, r)
 	}
@@ -240,46 +418,62 @@ func FilesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-// ListHandler lists all transfer Requests
+// ListHandler lists transfer requests of given type along with progress of their
+// groups, or requests derived from given parent request
 func ListHandler(w http.ResponseWriter, r *http.Request) {
-
-	query := r.URL.RawQuery
 	if r.Method != "GET" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	parameter := strings.Split(query, "=")
-
-	if parameter[0] == "type" {
-		var requests []core.TransferRequest
-		if parameter[1] == "pending" {
-			requests = core.RequestQueue.GetAllRequest()
-		} else {
-			var err error
-			requests, err = core.TFC.ListRequest(parameter[1])
-			if err != nil {
-				logs.WithFields(logs.Fields{
-					"Error": err,
-				}).Error("ListRequest handler")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+	rtype := r.FormValue("type")
+	parent := r.FormValue("parent")
+	if rtype == "" && parent == "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Could not find type url parameter"))
+		return
+	}
+	var requests []core.TransferRequest
+	var err error
+	if parent != "" {
+		// list requests derived from given parent request
+		requests, err = core.TFC.Children(parent)
+	} else if rtype == "pending" {
+		core.RequestQueueLock.Lock()
+		requests = core.RequestQueue.GetAllRequest()
+		core.RequestQueueLock.Unlock()
+	} else {
+		var all []core.TransferRequest
+		all, err = core.TFC.ListRequest(rtype)
+		// show parent requests along with aggregate progress of their groups
+		for _, t := range all {
+			if t.Parent != "" {
+				continue
 			}
+			progress, e := core.TFC.GroupProgress(t.Id)
+			if e == nil && progress.Total > 0 {
+				t.Progress = &progress
+			}
+			requests = append(requests, t)
 		}
-		data, err := json.Marshal(requests)
-		if err != nil {
-			logs.WithFields(logs.Fields{
-				"Error": err,
-			}).Error("ListRequest handler")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(data)
-	} else {
+	}
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("ListRequest handler")
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Could not find type url parameter"))
+		return
+	}
+	data, err := json.Marshal(requests)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("ListRequest handler")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
 // StatusHandler provides information about the agent
@@ -297,7 +491,7 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	astats := core.AgentStatus{Addrs: addrs, Catalog: core.TFC.Type, Name: _alias, Url: _myself, Protocol: _protocol, Backend: _backend, Tool: _tool, ToolOpts: _toolOpts, Agents: _agents, TimeStamp: time.Now().Unix(), Metrics: core.AgentMetrics.ToDict(), CpuUsage: cusage, MemUsage: musage}
+	astats := core.AgentStatus{Addrs: addrs, Catalog: core.TFC.Type, Name: _alias, Url: _myself, Protocol: _protocol, Backend: _backend, Tool: _tool, ToolOpts: _toolOpts, Agents: core.Agents.Map(), TimeStamp: time.Now().Unix(), Metrics: core.AgentMetrics.ToDict(), CpuUsage: cusage, MemUsage: musage, Throttle: core.AgentThrottle.Status(), Space: core.AgentSpace.Status()}
 	data, err := json.Marshal(astats)
 	if err != nil {
 		logs.WithFields(logs.Fields{
@@ -317,7 +511,7 @@ func AgentsHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	data, err := json.Marshal(_agents)
+	data, err := json.Marshal(core.Agents.Map())
 	if err != nil {
 		logs.WithFields(logs.Fields{
 			"Error": err,
@@ -339,7 +533,7 @@ func DefaultHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	// TODO: implement here default page for data-service
 	// should be done via templates
-	msg := fmt.Sprintf("Default page: %v\nagents: %v\n", time.Now(), _agents)
+	msg := fmt.Sprintf("Default page: %v\nagents: %v\n", time.Now(), core.Agents.Map())
 	w.Write([]byte(msg))
 }
 
@@ -486,6 +680,10 @@ func PushHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// inlineActions lists request actions which are applied by ActionHandler
+// itself, other actions are put into transfer queue
+var inlineActions = []string{core.Approve, core.Reject, "update", "abort", "priority", "reprioritize", "cancel", "retry"}
+
 // ActionHandler handles operations on requests
 func ActionHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -503,14 +701,34 @@ func ActionHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	for _, job := range data {
+		auditAction(r, job.Action, job.TransferRequest.Id)
+		if !authorizedAction(r, job.Action) {
+			msg := fmt.Sprintf("You are not authorized to perform %s action", job.Action)
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+	}
+	// jobs of source or destination agent are put into transfer queue before
+	// any other action is applied, the whole batch is rejected if queue is full
+	var queued []core.Job
+	for _, job := range data {
+		if !utils.InList(job.Action, inlineActions) {
+			queued = append(queued, job)
+		}
+	}
+	if !submitJobs(w, core.TransferQueue, queued) {
+		return
+	}
 	// loop over received data and decide what to do with those requests based on the action clause
 	for _, job := range data {
 		logs.WithFields(logs.Fields{
 			"Job": job.String(),
 		}).Info("ActionHandler, receive new request")
-		if job.Action == "approve" { // this is action happens on main agent
+		if job.Action == core.Approve || job.Action == core.Reject { // this is action happens on main agent
 			// find out real transfer request
-			err = core.TFC.RetrieveRequest(&job.TransferRequest)
+			tr := core.TransferRequest{Id: job.TransferRequest.Id}
+			err = core.TFC.RetrieveRequest(&tr)
 			if err != nil {
 				logs.WithFields(logs.Fields{
 					"Job":   job,
@@ -518,28 +736,86 @@ func ActionHandler(w http.ResponseWriter, r *http.Request) {
 				}).Error("ActionHandler, unable to find a request")
 				continue
 			}
-			tr := job.TransferRequest
+			approved, err := core.Decide(tr, requestUser(r), job.Action, job.Comment)
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Job":   job.String(),
+					"Error": err,
+				}).Error("ActionHandler unable to record approval decision")
+				continue
+			}
+			if !approved {
+				continue
+			}
 			// Split the request according to model type and router
-			err = core.RedirectRequest(&tr)
+			err = core.Dispatch(&tr)
 			if err != nil {
 				logs.WithFields(logs.Fields{
 					"Error": err,
 					"Model": _config.Type,
 					"Job":   job.String(),
 				}).Error("ActionHandler unable to send transfer request to agent")
+				// approved request is not approved again, it can be dispatched by retry action
+				if !tr.Expired() {
+					core.RequestQueueLock.Lock()
+					core.RequestQueue.Delete(tr.Id)
+					core.RequestQueueLock.Unlock()
+					core.TFC.UpdateRequest(tr.Id, "error")
+				}
 			} else {
 				logs.WithFields(logs.Fields{
 					"Job": job.String(),
 				}).Info("ActionHandler, successfully send request to agent")
 			}
 		} else if job.Action == "update" { // this happens on main agent
+			// request group is taken from stored request rather than from the job
+			stored := core.TransferRequest{Id: job.TransferRequest.Id}
+			if err := core.TFC.RetrieveRequest(&stored); err != nil || stored.Status == "" || stored.Status == "cancelled" {
+				continue // unknown request or late update of cancelled request
+			}
 			err := core.TFC.UpdateRequest(job.TransferRequest.Id, job.TransferRequest.Status)
 			if err == nil {
+				core.RequestQueueLock.Lock()
 				core.RequestQueue.Delete(job.TransferRequest.Id) // Remove request from heap.
+				core.RequestQueueLock.Unlock()
+			}
+			if parent := stored.Parent; err == nil && parent != "" {
+				err = core.UpdateGroup(parent)
+				if err != nil {
+					logs.WithFields(logs.Fields{
+						"Parent": parent,
+						"Error":  err,
+					}).Error("ActionHandler unable to update request group")
+				}
+			}
+		} else if job.Action == "abort" { // this happens on agents which hold jobs of cancelled request
+			count := core.AgentTransfers.Cancel(job.TransferRequest.Id)
+			logs.WithFields(logs.Fields{
+				"Request":   job.TransferRequest.Id,
+				"Transfers": count,
+			}).Info("ActionHandler, abort transfers")
+		} else if job.Action == "priority" { // this happens on main agent
+			err = core.Reprioritize(job.TransferRequest.Id, job.TransferRequest.Priority)
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Job":   job.String(),
+					"Error": err,
+				}).Error("ActionHandler unable to change request priority")
+			}
+		} else if job.Action == "reprioritize" { // this happens on agents which hold jobs of the request
+			core.ReprioritizeJobs(job.TransferRequest.Id, job.TransferRequest.Priority)
+		} else if job.Action == "cancel" || job.Action == "retry" { // bulk actions on request group happen on main agent
+			if job.Action == "cancel" {
+				err = core.CancelGroup(job.TransferRequest.Id, requestUser(r))
+			} else {
+				err = core.RetryGroup(job.TransferRequest.Id, requestUser(r))
+			}
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Job":   job.String(),
+					"Error": err,
+				}).Error("ActionHandler unable to process request group")
 			}
-		} else { // this action happens either on source or destination agent
-			// we put received job into transfer queue
-			core.TransferQueue <- job
 		}
 	}
 	w.WriteHeader(http.StatusOK)
@@ -664,10 +940,11 @@ func TFCHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// RegisterAgentHandler registers current agent with another one
+// RegisterAgentHandler registers (POST) or deregisters (DELETE) another agent
+// with current one
 func RegisterAgentHandler(w http.ResponseWriter, r *http.Request) {
 
-	if r.Method != "POST" {
+	if r.Method != "POST" && r.Method != "DELETE" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -683,21 +960,45 @@ func RegisterAgentHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	// register another agent
 	agent := agentParams.Agent
 	alias := agentParams.Alias
-	if aurl, ok := _agents[alias]; ok {
-		if aurl != agent {
-			msg := fmt.Sprintf("Agent %s (%s) already exists in agents map, %v\n", alias, aurl, _agents)
+	if !agentMatches(r, agent) {
+		msg := fmt.Sprintf("Agent certificate does not match %s", agent)
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+	if r.Method == "DELETE" {
+		// graceful shutdown of another agent
+		if core.Agents.Deregister(alias, agent) {
+			_members.SetState(alias, core.AgentDead)
+			logs.WithFields(logs.Fields{
+				"Agent": agent,
+				"Alias": alias,
+			}).Println("RegisterAgentHandler deregistered agent")
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// register another agent
+	aurl := core.Agents.Url(alias)
+	if aurl != "" && aurl != agent {
+		// agent may be restarted on a new url, we replace its registration
+		// only if agent with old url is gone
+		if !agentGone(alias, aurl) {
+			msg := fmt.Sprintf("Agent %s (%s) already exists in agents map, %v\n", alias, aurl, core.Agents.Map())
 			w.WriteHeader(http.StatusConflict)
 			w.Write([]byte(msg))
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-	} else {
-		_agents[alias] = agent // register given agent/alias pair internally
-		w.WriteHeader(http.StatusOK)
+		logs.WithFields(logs.Fields{
+			"Alias": alias,
+			"Old":   aurl,
+			"Agent": agent,
+		}).Println("RegisterAgentHandler agent changed its url")
 	}
+	core.Agents.Seen(alias, agent) // register given agent/alias pair internally
+	_members.Add(alias, agent)
+	w.WriteHeader(http.StatusOK)
 }
 
 // RegisterProtocolHandler registers current agent with another one
@@ -755,25 +1056,209 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// assign requests to the user and check their quotas before we queue them
+	user := requestUser(r)
+	for i := range *requests {
+		t := &(*requests)[i]
+		err = ingestRequest(t)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Request": t.String(),
+				"Error":   err,
+			}).Error("RequestHandler rejects request")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.User = user.Name
+		t.TimeStamp = time.Now().Unix()
+		t.Id = t.UUID()
+		if core.AgentQuotas != nil || core.AgentApprovals != nil {
+			// size of the request is always taken from source agent catalog
+			t.Bytes, err = core.RequestBytes(*t)
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Request": t.String(),
+					"Error":   err,
+				}).Error("RequestHandler unable to get size of the request")
+				http.Error(w, fmt.Sprintf("Unable to get size of the request: %v", err), http.StatusBadGateway)
+				return
+			}
+		}
+	}
+	// usage of requests is reserved until storage workers store them, therefore
+	// concurrent submissions can't overshoot the quotas
+	err = core.AgentQuotas.Reserve(*requests)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"User":  user.Name,
+			"Error": err,
+		}).Error("RequestHandler rejects requests")
+		if _, ok := err.(*core.QuotaError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
 	// go through each request and queue items individually to run job over the given request
-	for _, r := range *requests {
+	var works []core.Job
+	for _, t := range *requests {
 		logs.WithFields(logs.Fields{
-			"Request": r,
+			"Request": t,
 		}).Info("RequestHandler received request")
 
 		// this action will cause main agent to store given request in heap and persistent storage (REQUEST table)
-		r.Id = r.UUID()
-		work := core.Job{TransferRequest: r, Action: "store"}
+		works = append(works, core.Job{TransferRequest: t, Action: "store"})
+	}
+
+	// Push the work onto the queue.
+	if !submitJobs(w, core.StorageQueue, works) {
+		for _, t := range *requests {
+			core.AgentQuotas.Release(t.Id)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// helper function to reset server side attributes of incoming request, i.e.
+// its status, size and request group, agent urls, route and relays of the request
+// are resolved from the agent registry
+func ingestRequest(t *core.TransferRequest) error {
+	t.Status = ""
+	t.Bytes = 0
+	t.Parent = ""
+	t.Progress = nil
+	t.Route = nil
+	t.Relays = nil
+	t.SrcUrl = core.Agents.Url(t.SrcAlias)
+	if t.SrcUrl == "" {
+		return fmt.Errorf("Unknown source agent %s", t.SrcAlias)
+	}
+	t.DstUrl = core.Agents.Url(t.DstAlias)
+	if t.DstUrl == "" {
+		return fmt.Errorf("Unknown destination agent %s", t.DstAlias)
+	}
+	return nil
+}
 
-		// Push the work onto the queue.
-		core.StorageQueue <- work
+// ApprovalsHandler provides pending requests along with their approvals and
+// missing roles, or approvals of given request
+func ApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var rec interface{}
+	var err error
+	if rid := r.FormValue("request"); rid != "" {
+		rec, err = core.TFC.Approvals(rid)
+	} else {
+		rec, err = core.PendingApprovals()
+	}
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("ApprovalsHandler unable to get approvals")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("ApprovalsHandler unable to marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// QuotaHandler provides quota usage and limits of given user and destination site,
+// by default it shows quota of the caller
+func QuotaHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.FormValue("user")
+	site := r.FormValue("site")
+	caller := requestUser(r)
+	if user == "" && site == "" {
+		user = caller.Name
+	}
+	// users see their own usage, site usage is visible to site data managers
+	if (user != "" && user != caller.Name && !core.AgentPolicy.Admin(caller)) || (site != "" && !core.AgentPolicy.SiteManager(caller, site)) {
+		logs.WithFields(logs.Fields{
+			"Caller": caller.Name,
+			"User":   user,
+			"Site":   site,
+		}).Error("QuotaHandler access denied")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	rec, err := core.AgentQuotas.Usage(user, site)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"User":  user,
+			"Site":  site,
+			"Error": err,
+		}).Error("QuotaHandler unable to get quota usage")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("QuotaHandler unable to marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
 
+// Lfn2PfnHandler maps lfn to pfn (or pfn to lfn) of given protocol with trivial file catalog rules of the agent
+func Lfn2PfnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	m := core.Mapping{Protocol: r.FormValue("protocol"), Lfn: r.FormValue("lfn"), Pfn: r.FormValue("pfn")}
+	if m.Protocol == "" {
+		m.Protocol = _protocol
+	}
+	var err error
+	if m.Lfn != "" {
+		m.Pfn, err = core.Lfn2Pfn(m.Protocol, _backend, m.Lfn)
+	} else if m.Pfn != "" {
+		m.Lfn, err = core.Pfn2Lfn(m.Protocol, _backend, m.Pfn)
+	} else {
+		err = fmt.Errorf("Either lfn or pfn is required")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("Lfn2PfnHandler unable to marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
+// uploadCounter provides unique keys of space reservations of uploads
+var uploadCounter uint64
+
 // UploadDataHandler upload TransferRecord record and send back catalog entry to recipient
 // http://sanatgersappa.blogspot.com/2013/03/handling-multiple-file-uploads-in-go.html
+// The space is reserved per upload, concurrent uploads of the same LFN do not
+// share their reservations.
 func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "POST" {
@@ -805,22 +1290,44 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 	srcAlias := r.Header.Get("Src")
 	dstAlias := r.Header.Get("Dst")
 	lfn := r.Header.Get("Lfn")
-	arr := strings.Split(lfn, "/")
-	fname := arr[len(arr)-1]
-	pfn := fmt.Sprintf("%s/%s", _backend, fname)
 	time0 := time.Now().Unix()
+	if !boundAgent(r, srcAlias) {
+		msg := fmt.Sprintf("Agent certificate does not match %s", srcAlias)
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+
+	// take transfer slot of the link, the sender will retry when we're busy
+	release, e := core.AgentThrottle.Acquire(srcAlias, dstAlias)
+	if e != nil {
+		tooManyTransfers(w, srcAlias, dstAlias)
+		return
+	}
+	defer release()
 
-	// create a file which we'll write
-	file, e := os.Create(pfn)
-	defer file.Close()
+	// reserve space for the file, the sender will retry when it does not fit
+	bytes, _ := strconv.ParseInt(srcBytes, 10, 64)
+	key := fmt.Sprintf("upload-%d:%s", atomic.AddUint64(&uploadCounter, 1), lfn)
+	e = core.AgentSpace.Reserve(key, bytes)
+	if e != nil {
+		noSpace(w, lfn, bytes, e)
+		return
+	}
+	defer core.AgentSpace.Release(key)
+
+	// create a file in the pool which we'll write, it appears under its pfn once
+	// data are verified and it is removed if upload fails, e.g. it is aborted by the sender
+	file, e := core.AgentStager.Create(lfn)
 	if e != nil {
 		logs.WithFields(logs.Fields{
-			"PFN":   pfn,
+			"LFN":   lfn,
 			"Error": e,
-		}).Error("ERROR UploadDataHandler unable to open", pfn, e)
+		}).Error("ERROR UploadDataHandler unable to create", lfn, e)
 		http.Error(w, e.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer file.Discard()
+	pfn := file.Path()
 	// create a hasher to calculate data hash
 	hasher := adler32.New()
 
@@ -831,15 +1338,15 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		if e == io.EOF {
 			break
 		}
-		if p.FileName() == "" {
-			continue
-		}
 		if e != nil {
 			logs.WithFields(logs.Fields{
 				"Error": e,
 			}).Error("UploadDataHandler unable to read chunk from the stream", e)
 			break
 		}
+		if p.FileName() == "" {
+			continue
+		}
 		// here is pipe: mr->p->hasher->file
 		reader := io.TeeReader(p, hasher)
 		b, e := io.Copy(file, reader)
@@ -874,12 +1381,23 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// flush data to disk and move file to its pfn
+	e = file.Commit()
+	if e != nil {
+		logs.WithFields(logs.Fields{
+			"PFN":   pfn,
+			"Error": e,
+		}).Error("UploadDataHandler unable to commit file")
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// send back catalog entry which can be used for verification
 	// but do not write to catalog since another end should verify first that
 	// data is transferred, then it will update the TFC
 	logs.WithFields(logs.Fields{
 		"Source Alias": srcAlias,
-		"Fname":        fname,
+		"LFN":          lfn,
 		"Dest Alias":   dstAlias,
 		"PFN":          pfn,
 	}).Println("UploadDataHandler wrote")
@@ -897,6 +1415,43 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// throttledWriter writes HTTP response within bandwidth limits of a link
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	src, dst string
+}
+
+// Write implements io.Writer interface
+func (w *throttledWriter) Write(data []byte) (int, error) {
+	err := core.AgentThrottle.Consume(w.ctx, w.src, w.dst, len(data))
+	if err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// helper function to reply to transfer which exceeds concurrency limits
+func tooManyTransfers(w http.ResponseWriter, src, dst string) {
+	logs.WithFields(logs.Fields{
+		"Source":      src,
+		"Destination": dst,
+	}).Warn("Transfer limit is reached")
+	w.Header().Set("Retry-After", "60")
+	http.Error(w, core.ErrTooManyTransfers.Error(), http.StatusTooManyRequests)
+}
+
+// helper function to reject transfer which does not fit into agent pool
+func noSpace(w http.ResponseWriter, lfn string, bytes int64, err error) {
+	logs.WithFields(logs.Fields{
+		"LFN":   lfn,
+		"Bytes": bytes,
+		"Error": err,
+	}).Warn("Unable to reserve space")
+	w.Header().Set("Retry-After", "60")
+	http.Error(w, err.Error(), http.StatusInsufficientStorage)
+}
+
 // DownloadHandler handles download agent's request
 func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -905,24 +1460,49 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	args := r.URL.Query()
 	if files, ok := args["lfn"]; ok {
-		if core.AgentStager.Exist(files[0]) {
-			var fin *os.File
-			fname := core.AgentStager.Access(files[0])
-			fin, err := os.Open(fname)
+		lfn := files[0]
+		switch core.AgentStager.Status(lfn) {
+		case core.StageOnline:
+			// take transfer slot of the link, the recipient will retry when we're busy
+			dst := downloadPeer(r)
+			release, err := core.AgentThrottle.Acquire(_alias, dst)
+			if err != nil {
+				tooManyTransfers(w, _alias, dst)
+				return
+			}
+			defer release()
+			info, err := core.AgentStager.Stat(lfn)
+			var fin core.StagedFile
+			if err == nil {
+				fin, err = core.AgentStager.Open(lfn)
+			}
 			if err != nil {
 				logs.WithFields(logs.Fields{
 					"Error": err,
-					"File":  fname,
+					"Lfn":   lfn,
 				}).Error("unable to open file in stager")
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			// we don't need to WriteHeader here since it is handled by http.ServeContent
-			http.ServeContent(w, r, fname, time.Now(), fin)
-			return
+			defer fin.Close()
+			// we don't need to WriteHeader here since it is handled by http.ServeContent,
+			// it also serves byte ranges of the file. The data are sent within
+			// bandwidth limits of the link.
+			tw := &throttledWriter{ResponseWriter: w, ctx: r.Context(), src: _alias, dst: dst}
+			http.ServeContent(tw, r, info.Name(), info.ModTime(), fin)
+		case core.StageOffline:
+			if err := core.AgentStager.Stage(lfn); err != nil {
+				logs.WithFields(logs.Fields{
+					"Lfn":   lfn,
+					"Error": err,
+				}).Error("unable to stage file")
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
 		}
-		core.AgentStager.Stage(files[0])
-		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 	w.WriteHeader(http.StatusBadRequest)
@@ -951,3 +1531,119 @@ func VerboseHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// IdentitiesHandler reloads identities from identity provider (POST) and
+// provides information about known identities (GET)
+func IdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if core.AgentIdentities == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method == "POST" {
+		err := core.AgentIdentities.Reload()
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error": err,
+			}).Error("IdentitiesHandler unable to reload identities")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	rec := make(map[string]interface{})
+	rec["identities"] = core.AgentIdentities.Size()
+	rec["timestamp"] = core.AgentIdentities.TimeStamp()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("IdentitiesHandler unable to marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// SharesHandler provides fair-share weights along with ready jobs of
+// destinations and users, POST request replaces the weights
+func SharesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == "POST" {
+		defer r.Body.Close()
+		var shares core.Shares
+		err := json.NewDecoder(r.Body).Decode(&shares)
+		if err == nil {
+			err = core.AgentShares.Set(shares)
+		}
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error": err,
+			}).Error("SharesHandler unable to set weights")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logs.WithFields(logs.Fields{
+			"User":   requestUser(r).Name,
+			"Shares": shares,
+		}).Info("Fair-share weights are changed")
+	}
+	rec := make(map[string]interface{})
+	rec["shares"] = core.AgentShares.Get()
+	rec["transfer"] = core.TransferQueue.Flows()
+	rec["storage"] = core.StorageQueue.Flows()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("SharesHandler unable to marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// LimitsHandler provides transfer limits along with number of running
+// transfers, POST request replaces the limits
+func LimitsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == "POST" {
+		defer r.Body.Close()
+		var limits core.Limits
+		err := json.NewDecoder(r.Body).Decode(&limits)
+		if err == nil {
+			err = core.AgentThrottle.Set(limits)
+		}
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Error": err,
+			}).Error("LimitsHandler unable to set limits")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logs.WithFields(logs.Fields{
+			"User":   requestUser(r).Name,
+			"Limits": limits,
+		}).Info("Transfer limits are changed")
+	}
+	data, err := json.Marshal(core.AgentThrottle.Status())
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("LimitsHandler unable to marshal")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
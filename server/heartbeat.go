@@ -0,0 +1,105 @@
+package server
+
+// transfer2go agent liveness, agents exchange heartbeats and dead agents are deregistered
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// reapHeartbeats defines number of heartbeat intervals after which dead agent
+// is removed from membership view and agent registry
+const reapHeartbeats = 20
+
+// helper function to periodically gossip membership view with other agents and
+// deregister agents which stopped sending their heartbeats, dead agents are
+// removed after a while
+func heartbeats(ctx context.Context, interval time.Duration, fanout int) {
+	for {
+		gossipRound(fanout)
+		core.Agents.Seen(_alias, _myself)
+		for _, rec := range core.Agents.Check(interval) {
+			_members.SetState(rec.Alias, core.AgentDead)
+			logs.WithFields(logs.Fields{
+				"Agent": rec.String(),
+			}).Warn("Agent is dead, deregister it")
+		}
+		_members.Reap(reapHeartbeats * interval)
+		for _, rec := range core.Agents.Reap(reapHeartbeats * interval) {
+			logs.WithFields(logs.Fields{
+				"Agent": rec.String(),
+			}).Println("Dead agent is removed")
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// helper function to deregister this agent at all known agents, it is used
+// during graceful shutdown of the agent
+func deregisterAtAgents() {
+	params := AgentInfo{Agent: _myself, Alias: _alias}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	client := utils.HttpClient()
+	for alias, aurl := range core.Agents.Map() {
+		if alias == _alias {
+			continue
+		}
+		req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/register", aurl), bytes.NewBuffer(data))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Agent": aurl,
+				"Error": err,
+			}).Warn("Unable to deregister")
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// helper function to check if agent registered under given alias is gone,
+// i.e. it is not alive or does not respond anymore
+func agentGone(alias, aurl string) bool {
+	if core.Agents.State(alias) != core.AgentAlive {
+		return true
+	}
+	return core.CheckAgent(aurl) != nil
+}
+
+// HeartbeatHandler provides records of all known agents, heartbeats of agents
+// are exchanged via gossip
+func HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.Marshal(core.Agents.List())
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("HeartbeatHandler", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
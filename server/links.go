@@ -0,0 +1,188 @@
+package server
+
+// transfer2go link registry, it keeps track of network links between agents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	logs "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// maxProbeFailures defines number of consecutive failed probes after which link is considered unhealthy
+const maxProbeFailures = 3
+
+// maxProbeSize defines maximum size of the probe data agent will serve
+const maxProbeSize = 16 * 1048576
+
+// Link represents network link between two agents
+type Link struct {
+	Src        string  `json:"src"`        // source agent alias, i.e. agent which probes the link
+	Dst        string  `json:"dst"`        // destination agent alias
+	Latency    float64 `json:"latency"`    // round trip time of the probe in milliseconds
+	Throughput float64 `json:"throughput"` // throughput of small-transfer probe in MB/s
+	Healthy    bool    `json:"healthy"`    // link health
+	Failures   int     `json:"failures"`   // number of consecutive failed probes
+	TimeStamp  int64   `json:"ts"`         // time stamp of the last probe
+}
+
+// LinkRegistry keeps track of links between agents
+type LinkRegistry struct {
+	sync.RWMutex
+	Links map[string]Link // links of agents, the key is src->dst pair
+}
+
+// global link registry of the agent
+var _links = LinkRegistry{Links: make(map[string]Link)}
+
+// String provides string representation of the link
+func (l *Link) String() string {
+	return fmt.Sprintf("<Link src=%s dst=%s latency=%v throughput=%v healthy=%v failures=%d ts=%d>", l.Src, l.Dst, l.Latency, l.Throughput, l.Healthy, l.Failures, l.TimeStamp)
+}
+
+// Update puts given link into registry. The probed link keeps track of consecutive
+// failures while links received from other agents are taken only if they are newer.
+func (r *LinkRegistry) Update(link Link, probed bool) {
+	r.Lock()
+	defer r.Unlock()
+	key := fmt.Sprintf("%s->%s", link.Src, link.Dst)
+	prev, ok := r.Links[key]
+	if probed {
+		if !link.Healthy {
+			link.Failures = prev.Failures + 1
+			link.Healthy = ok && prev.Healthy && link.Failures < maxProbeFailures
+		}
+	} else if ok && prev.TimeStamp >= link.TimeStamp {
+		return
+	}
+	r.Links[key] = link
+	core.AgentLinks.SetHealth(link.Src, link.Dst, link.Healthy)
+	core.AgentLinks.SetMetrics(link.Src, link.Dst, link.Latency, link.Throughput)
+}
+
+// List returns list of all known links
+func (r *LinkRegistry) List() []Link {
+	r.RLock()
+	defer r.RUnlock()
+	var out []Link
+	for _, link := range r.Links {
+		out = append(out, link)
+	}
+	return out
+}
+
+// helper function to probe a link from this agent to given one, it measures
+// latency of empty probe and throughput of the probe with given size
+func probeLink(alias, aurl string, size int) Link {
+	link := Link{Src: _alias, Dst: alias, TimeStamp: time.Now().Unix()}
+	time0 := time.Now()
+	resp := utils.FetchResponse(fmt.Sprintf("%s/probe", aurl), []byte{})
+	if resp.Error != nil || resp.StatusCode != http.StatusOK {
+		return link
+	}
+	link.Latency = float64(time.Since(time0).Nanoseconds()) / 1e6
+	link.Healthy = true
+	time0 = time.Now()
+	resp = utils.FetchResponse(fmt.Sprintf("%s/probe?size=%d", aurl, size), []byte{})
+	if resp.Error == nil && resp.StatusCode == http.StatusOK && len(resp.Data) == size {
+		link.Throughput = float64(size) / 1048576 / time.Since(time0).Seconds()
+	}
+	return link
+}
+
+// helper function to fetch links known to remote agent
+func remoteLinks(aurl string) ([]Link, error) {
+	resp := utils.FetchResponse(fmt.Sprintf("%s/links", aurl), []byte{})
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	var links []Link
+	err := json.Unmarshal(resp.Data, &links)
+	return links, err
+}
+
+// helper function to periodically probe links to all known agents and collect
+// links measured by them, such that every agent has a view of entire network.
+// The measured latency and throughput define cost of the links for routing.
+func probeLinks(ctx context.Context, interval time.Duration, size int) {
+	for {
+		for alias, aurl := range core.Agents.Map() {
+			if alias == _alias {
+				continue
+			}
+			link := probeLink(alias, aurl, size)
+			_links.Update(link, true)
+			if utils.VERBOSE > 0 {
+				logs.WithFields(logs.Fields{
+					"Link": link.String(),
+				}).Println("Probe link")
+			}
+			if !link.Healthy {
+				continue
+			}
+			links, err := remoteLinks(aurl)
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Agent": aurl,
+					"Error": err,
+				}).Warn("Unable to get links of remote agent")
+				continue
+			}
+			// agent reports only links it measured itself
+			for _, l := range links {
+				if l.Src == alias {
+					_links.Update(l, false)
+				}
+			}
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LinksHandler returns list of links known to the agent
+func LinksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := json.Marshal(_links.List())
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("LinksHandler", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// ProbeHandler serves probe data of requested size to measure link properties
+func ProbeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var size int
+	if v := r.FormValue("size"); v != "" {
+		var err error
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 0 || size > maxProbeSize {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(make([]byte, size))
+}
@@ -4,13 +4,18 @@ package server
 // Author: Valentin Kuznetsov <vkuznet@gmail.com>
 
 import (
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	logs "github.com/sirupsen/logrus"
 	"github.com/vkuznet/transfer2go/core"
@@ -35,23 +40,53 @@ type Config struct {
 	Minterval      int64  `json:"minterval"`      // metrics interval
 	Staticdir      string `json:"staticdir"`      // static dir defines location of static files, e.g. sql,js templates
 	Workers        int    `json:"workers"`        // number of workers
-	QueueSize      int    `json:"queuesize"`      // total size of the queue
+	QueueSize      int    `json:"queuesize"`      // maximum number of queued jobs, default 100
 	Port           int    `json:"port"`           // port number given server runs on, default 8989
 	Base           string `json:"base"`           // URL base path for agent server, it will be extracted from Url
 	Register       string `json:"register"`       // remote agent URL to register
 	ServerKey      string `json:"serverkey"`      // server key file
 	ServerCrt      string `json:"servercrt"`      // server crt file
 	Type           string `json:"type"`           // Configure server type push/pull
-	BufferSize     int    `json:"buffersize"`     // Size of buffered channels
 	MonitorTime    int64  `json:"monitorTime"`    // Large time interval after which we need to reset monitoring calculation
 	TrainInterval  string `json:"trinterval"`     // Time after which we need to retrain main agent
 	RouterModel    bool   `json:"router"`         // Variable to enable the router model
 	TransferDelay  int    `json:"transferDelay"`  // Transfer delay threshold in seconds
+	PriorityAging  int    `json:"priorityAging"`  // time in seconds a queued job waits to gain one level of priority, default 600
+	Links          string `json:"links"`          // link graph file name used for multi-hop transfers
+	ProbeInterval  int    `json:"probeInterval"`  // interval in seconds between link probes, default 60
+	ProbeSize      int    `json:"probeSize"`      // size in bytes of the probe to measure link throughput, default 1MB
+	Heartbeat      int    `json:"heartbeat"`      // interval in seconds between agent heartbeats, default 30
+	GossipFanout   int    `json:"gossipFanout"`   // number of agents to gossip with every heartbeat, default 3
+	Policy         string `json:"policy"`         // authorization policy file name, by default everything is allowed
+	Identity       string `json:"identity"`       // identity provider: file, http or static
+	IdentitySource string `json:"identitySource"` // identity file name, url or semicolon separated list of DNs
+	IdentityReload int    `json:"identityReload"` // interval in seconds between identity reloads, default 3600
+	Jwks           string `json:"jwks"`           // JWKS file name or url with keys of token issuer
+	TokenIssuer    string `json:"tokenIssuer"`    // expected issuer of bearer tokens
+	TokenAudience  string `json:"tokenAudience"`  // expected audience of bearer tokens
+	TokenHosts     string `json:"tokenHosts"`     // comma separated list of hosts which receive bearer token of the agent
+	CACerts        string `json:"cacerts"`        // directory with trusted CA certificates, it enables mutual TLS between agents
+	AuditFile      string `json:"auditFile"`      // audit log file name (JSON-lines), audit records are always stored in DB
+	Quotas         string `json:"quotas"`         // quota policy file name, by default there are no quotas
+	Approvals      string `json:"approvals"`      // approval policy file name, by default single approval is required
+	StopTimeout    int    `json:"stopTimeout"`    // time in seconds to wait for HTTP requests and then for running jobs on shutdown, default 30
+	Rules          string `json:"rules"`          // trivial file catalog rules file name, by default LFN is placed into backend area
+	Stager         string `json:"stager"`         // stager of the agent pool, by default filesystem stager of backend area
+	StagerProtocol string `json:"stagerProtocol"` // protocol of trivial file catalog rules which locate files in the pool, by default agent protocol
+
+	// fair-share weights of destinations and users, by default all weights are 1
+	Shares core.Shares `json:"shares"`
+	// bandwidth and concurrency limits of the agent and of its links, by default there are no limits
+	Limits core.Limits `json:"limits"`
+	// transfer windows of the agent, by default transfers are always allowed
+	Windows []core.Window `json:"windows"`
+	// high and low watermarks of used space of the pool, by default 0.95 and 0.90
+	Watermarks core.Watermarks `json:"watermarks"`
 }
 
 // String returns string representation of Config data type
 func (c *Config) String() string {
-	return fmt.Sprintf("<Config: name=%s url=%s port=%d base=%s catalog=%s protocol=%s backend=%s tool=%s opts=%s mfile=%s minterval=%d staticdir=%s workders=%d queuesize=%d register=%s type=%s router=%v>", c.Name, c.Url, c.Port, c.Base, c.Catalog, c.Protocol, c.Backend, c.Tool, c.ToolOpts, c.Mfile, c.Minterval, c.Staticdir, c.Workers, c.QueueSize, c.Register, c.Type, c.RouterModel)
+	return fmt.Sprintf("<Config: name=%s url=%s port=%d base=%s catalog=%s protocol=%s backend=%s tool=%s opts=%s mfile=%s minterval=%d staticdir=%s workders=%d queuesize=%d register=%s type=%s router=%v links=%s>", c.Name, c.Url, c.Port, c.Base, c.Catalog, c.Protocol, c.Backend, c.Tool, c.ToolOpts, c.Mfile, c.Minterval, c.Staticdir, c.Workers, c.QueueSize, c.Register, c.Type, c.RouterModel, c.Links)
 }
 
 // AgentInfo data type
@@ -70,52 +105,43 @@ type AgentProtocol struct {
 
 // globals used in server/handlers
 var _myself, _alias, _protocol, _backend, _tool, _toolOpts string
-var _agents map[string]string
 var _config Config
 
-// init
-func init() {
-	_agents = make(map[string]string)
-}
-
-// register a new (alias, agent) pair in agent (register)
-func register(register, alias, agent string) error {
-	logs.WithFields(logs.Fields{
-		"Agent":    agent,
-		"Alias":    alias,
-		"Register": register,
-	}).Println("Register agent as alias on register")
-	// register myself with another agent
-	params := AgentInfo{Agent: _myself, Alias: _alias}
-	data, err := json.Marshal(params)
-	if err != nil {
-		logs.WithFields(logs.Fields{
-			"Params": params,
-		}).Error("Unable to marshal params", params)
-	}
-	url := fmt.Sprintf("%s/register", register)
-	resp := utils.FetchResponse(url, data) // POST request
-	// check return status code
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Response %s, error=%s", resp.Status, string(resp.Data))
-	}
-	return resp.Error
-}
+// Version of the agent, it is set by main program
+var Version string
 
-// helper function to register agent with all distributed agents
+// helper function to join distributed agents. The agent exchanges its membership
+// view with given seed agent and the rest of agents learn about it via gossip.
 func registerAtAgents(aName string) {
 	// register itself
-	if _, ok := _agents[_alias]; ok {
-		logs.WithFields(logs.Fields{
-			"Alias":  _alias,
-			"Agents": _agents,
-		}).Fatal("Unable to register, alias, since this name already exists")
+	capabilities := []string{_config.Type}
+	if _config.RouterModel {
+		capabilities = append(capabilities, "router")
 	}
-	_agents[_alias] = _myself
+	self := core.AgentRecord{Alias: _alias, Url: _myself, Protocol: _protocol, Backend: _backend, Capabilities: capabilities, Version: Version}
+	core.Agents.Register(self)
+	_members.Join(Member{Alias: self.Alias, Url: self.Url, Protocol: self.Protocol, Backend: self.Backend, Capabilities: self.Capabilities, Version: self.Version})
 
-	// now ask remote server for its list of agents and update internal map
+	// exchange membership view with seed agent
 	if aName != "" && len(aName) > 0 {
-		err := register(aName, _alias, _myself) // submit remote registration of given agent name
+		logs.WithFields(logs.Fields{
+			"Agent": _myself,
+			"Alias": _alias,
+			"Seed":  aName,
+		}).Println("Join agents via seed agent")
+		members, err := fetchMembers(aName, nil) // GET request
+		if err == nil {
+			for _, m := range members {
+				if m.Alias == _alias && m.Url != _myself && m.State != core.AgentDead {
+					logs.WithFields(logs.Fields{
+						"Alias":  _alias,
+						"Self":   _myself,
+						"Member": m.String(),
+					}).Fatal("Unable to register, alias, since this name already exists")
+				}
+			}
+			err = exchange(aName)
+		}
 		if err != nil {
 			logs.WithFields(logs.Fields{
 				"Alias": _alias,
@@ -124,27 +150,7 @@ func registerAtAgents(aName string) {
 				"Error": err,
 			}).Fatal("Unable to register")
 		}
-		aurl := fmt.Sprintf("%s/agents", aName)
-		resp := utils.FetchResponse(aurl, []byte{})
-		var remoteAgents map[string]string
-		e := json.Unmarshal(resp.Data, &remoteAgents)
-		if e == nil {
-			for key, val := range remoteAgents {
-				if _, ok := _agents[key]; !ok {
-					_agents[key] = val // register remote agent/alias pair internally
-				}
-			}
-		}
-	}
-
-	// complete registration with other agents
-	for alias, agent := range _agents {
-		if agent == aName || alias == _alias {
-			continue
-		}
-		register(agent, _alias, _myself) // submit remote registration of given agent name
 	}
-
 }
 
 // Server implementation
@@ -173,8 +179,154 @@ func Server(config Config) {
 		"Model":  config.Type,
 	}).Println("Agent")
 
-	// register self agent URI in remote agent and vice versa
-	registerAtAgents(config.Register)
+	// context of the agent, it is cancelled when agent receives SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logs.WithFields(logs.Fields{
+			"Signal": sig,
+		}).Println("Agent is stopping")
+		cancel()
+	}()
+
+	// load trusted CA certificates used for mutual TLS between agents
+	var err error
+	if config.CACerts != "" {
+		err = utils.LoadCACerts(config.CACerts)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"CACerts": config.CACerts,
+				"Error":   err,
+			}).Fatal("Unable to load CA certificates")
+		}
+	}
+
+	// initialize identity provider
+	if config.Identity != "" {
+		provider, err := core.NewIdentityProvider(config.Identity, config.IdentitySource)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Identity": config.Identity,
+				"Error":    err,
+			}).Fatal("Unable to initialize identity provider")
+		}
+		core.AgentIdentities, err = core.NewIdentityRegistry(provider)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Identity": config.Identity,
+				"Source":   config.IdentitySource,
+				"Error":    err,
+			}).Error("Unable to load identities")
+		}
+		if config.IdentityReload == 0 {
+			config.IdentityReload = 3600
+		}
+		go core.AgentIdentities.Refresh(ctx, time.Duration(config.IdentityReload)*time.Second)
+	} else if utils.Auth {
+		logs.Warn("No identity provider is configured, users with certificates are denied")
+	}
+
+	// bearer token of the agent is sent to trusted hosts only
+	if config.TokenHosts != "" {
+		utils.AddTokenHosts(strings.Split(config.TokenHosts, ",")...)
+	}
+	utils.AddTokenHosts(config.Register)
+
+	// initialize bearer token verification
+	if config.Jwks != "" {
+		core.AgentTokens, err = core.NewTokenVerifier(config.Jwks, config.TokenIssuer, config.TokenAudience)
+		if err != nil {
+			logs.WithFields(logs.Fields{
+				"Jwks":  config.Jwks,
+				"Error": err,
+			}).Fatal("Unable to load token keys")
+		}
+	}
+
+	// load authorization policy
+	core.AgentPolicy, err = core.LoadPolicy(config.Policy)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Policy": config.Policy,
+			"Error":  err,
+		}).Fatal("Unable to load authorization policy")
+	}
+
+	// load quota policy
+	core.AgentQuotas, err = core.LoadQuotas(config.Quotas)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Quotas": config.Quotas,
+			"Error":  err,
+		}).Fatal("Unable to load quota policy")
+	}
+
+	// load trivial file catalog rules
+	core.AgentRules, err = core.LoadRules(config.Rules)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Rules": config.Rules,
+			"Error": err,
+		}).Fatal("Unable to load trivial file catalog rules")
+	}
+
+	// load approval policy
+	core.AgentApprovals, err = core.LoadApprovals(config.Approvals)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Approvals": config.Approvals,
+			"Error":     err,
+		}).Fatal("Unable to load approval policy")
+	}
+
+	// set fair-share weights of destinations and users
+	err = core.AgentShares.Set(config.Shares)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Shares": config.Shares,
+			"Error":  err,
+		}).Fatal("Unable to set fair-share weights")
+	}
+
+	// set transfer limits of the agent and of its links
+	err = core.AgentThrottle.Set(config.Limits)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Limits": config.Limits,
+			"Error":  err,
+		}).Fatal("Unable to set transfer limits")
+	}
+
+	// set transfer windows of the agent
+	err = core.AgentWindows.Set(config.Windows)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Windows": config.Windows,
+			"Error":   err,
+		}).Fatal("Unable to set transfer windows")
+	}
+
+	// set watermarks of the agent pool
+	err = core.AgentSpace.SetWatermarks(config.Watermarks)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Watermarks": config.Watermarks,
+			"Error":      err,
+		}).Fatal("Unable to set watermarks")
+	}
+
+	// initialize audit log
+	core.AgentAudit, err = core.NewAuditLog(config.AuditFile)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"AuditFile": config.AuditFile,
+			"Error":     err,
+		}).Fatal("Unable to open audit log")
+	}
+	defer core.AgentAudit.Close()
 
 	// define catalog
 	c, e := ioutil.ReadFile(config.Catalog)
@@ -183,7 +335,7 @@ func Server(config Config) {
 			"Error": e,
 		}).Fatal("Unable to read catalog file")
 	}
-	err := json.Unmarshal([]byte(c), &core.TFC)
+	err = json.Unmarshal([]byte(c), &core.TFC)
 	if err != nil {
 		logs.WithFields(logs.Fields{
 			"Error": err,
@@ -210,10 +362,36 @@ func Server(config Config) {
 	core.DB = db
 	core.DBTYPE = dbtype
 	core.DBSQL = core.LoadSQL(dbtype, dbowner)
+	err = core.UpgradeSchema()
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Fatal("Unable to upgrade catalog schema")
+	}
 	logs.WithFields(logs.Fields{
 		"Catalog": core.TFC,
 	}).Println("")
 
+	// restore agents known before restart
+	err = core.Agents.Load()
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Warn("Unable to load agents")
+	}
+
+	// register self agent URI in remote agent and vice versa
+	registerAtAgents(config.Register)
+
+	// start gossiping heartbeats with other agents
+	if config.Heartbeat == 0 {
+		config.Heartbeat = 30
+	}
+	if config.GossipFanout == 0 {
+		config.GossipFanout = 3
+	}
+	go heartbeats(ctx, time.Duration(config.Heartbeat)*time.Second, config.GossipFanout)
+
 	// Define CentralCatalog
 	core.CC = core.CentralCatalog{Path: config.CentralCatalog}
 
@@ -228,33 +406,85 @@ func Server(config Config) {
 	} else {
 		core.TransferDelayThreshold = 300 // seconds
 	}
+	if config.PriorityAging != 0 {
+		core.PriorityAging = time.Duration(config.PriorityAging) * time.Second
+	}
+
+	// initialize link graph used to route requests through intermediate agents
+	core.AgentLinks, err = core.NewLinkGraph(config.Links, core.Agents)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Links": config.Links,
+			"Error": err,
+		}).Fatal("Unable to read link graph")
+	}
+
+	// start probing links to other agents
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = 60
+	}
+	if config.ProbeSize == 0 {
+		config.ProbeSize = 1048576
+	}
+	go probeLinks(ctx, time.Duration(config.ProbeInterval)*time.Second, config.ProbeSize)
 
 	// Check if RouterModel is enabled, then initialize router
 	if config.RouterModel == true {
 		logs.WithFields(logs.Fields{
 			"TrainInterval": _config.TrainInterval,
 		}).Println("Enabling router model")
-		cronJob := core.NewRouter(config.TrainInterval, &_agents, config.Cfile)
+		cronJob := core.NewRouter(config.TrainInterval, core.Agents, config.Cfile)
 		cronJob.Start()
 		defer cronJob.Stop() // Stop the cron job with the server crash
 	}
 
 	// initialize job queues
-	core.InitQueue(config.QueueSize, config.QueueSize, config.Mfile, config.Minterval, config.MonitorTime, config.RouterModel)
+	if config.QueueSize == 0 {
+		config.QueueSize = 100
+	}
+	core.InitQueue(ctx, config.QueueSize, config.QueueSize, config.Mfile, config.Minterval, config.MonitorTime, config.RouterModel)
 
-	if config.BufferSize == 0 {
-		config.BufferSize = 5
+	// initialize stager before workers start, stale temporary files of
+	// interrupted transfers are removed from its pool
+	core.AgentStager, err = core.NewStager(config.Stager, config.Backend, core.TFC)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Stager": config.Stager,
+			"Error":  err,
+		}).Fatal("Unable to initialize stager")
+	}
+	if fs, ok := core.AgentStager.(*core.FileSystemStager); ok {
+		// files are located by the same rules which agent reports via lfn2pfn
+		fs.Protocol = config.StagerProtocol
+		if fs.Protocol == "" {
+			fs.Protocol = config.Protocol
+		}
+		roots := fs.Roots()
+		for _, root := range roots {
+			err = os.MkdirAll(root, 0755)
+			if err != nil {
+				logs.WithFields(logs.Fields{
+					"Pool":  root,
+					"Error": err,
+				}).Fatal("Unable to create pool area")
+			}
+			if count := core.CleanTempFiles(root); count > 0 {
+				logs.WithFields(logs.Fields{
+					"Pool":  root,
+					"Files": count,
+				}).Warn("Removed stale temporary files")
+			}
+		}
+		core.AgentSpace.SetPath(roots...)
 	}
+
 	// initialize task dispatcher
-	dispatcher := core.NewDispatcher(config.Workers, config.BufferSize)
-	dispatcher.StorageRunner()
+	dispatcher := core.NewDispatcher(config.Workers)
+	dispatcher.StorageRunner(ctx)
 
 	// initialize transfer workers
-	transporter := core.NewDispatcher(config.Workers, config.BufferSize)
-	transporter.TransferRunner()
-
-	// initialize stager
-	core.AgentStager = core.NewStager(config.Backend, core.TFC)
+	transporter := core.NewDispatcher(config.Workers)
+	transporter.TransferRunner(ctx)
 
 	logs.WithFields(logs.Fields{
 		"Workers":       config.Workers,
@@ -262,22 +492,60 @@ func Server(config Config) {
 		"Transfer Type": config.Type,
 	}).Println("Start dispatcher")
 
+	server := &http.Server{Addr: ":" + port}
+	errs := make(chan error, 1)
 	if utils.Auth {
 		//start HTTPS server which require user certificates
-		server := &http.Server{
-			Addr: ":" + port,
-			TLSConfig: &tls.Config{
-				ClientAuth: tls.RequestClientCert,
-			},
+		tlsConfig := &tls.Config{ClientAuth: tls.RequestClientCert}
+		if utils.CACerts != nil {
+			// client certificates are verified against trusted CAs, the
+			// agent endpoints require verified agent certificate
+			tlsConfig.ClientCAs = utils.CACerts
+			tlsConfig.VerifyPeerCertificate = utils.VerifyPeerCertificate
 		}
-		err = server.ListenAndServeTLS(config.ServerCrt, config.ServerKey)
+		server.TLSConfig = tlsConfig
+		go func() {
+			errs <- server.ListenAndServeTLS(config.ServerCrt, config.ServerKey)
+		}()
 	} else {
-		err = http.ListenAndServe(":"+port, nil) // Start server without user certificates
+		go func() {
+			errs <- server.ListenAndServe() // Start server without user certificates
+		}()
 	}
 
-	if err != nil {
+	select {
+	case err = <-errs:
 		logs.WithFields(logs.Fields{
 			"Error": err,
 		}).Fatal("ListenAndServe: ")
+	case <-ctx.Done():
+	}
+
+	// graceful shutdown: deregister from other agents, stop accepting requests,
+	// wait for running jobs and persist queued ones. The router cron, audit log
+	// and DB are closed by deferred calls.
+	if config.StopTimeout == 0 {
+		config.StopTimeout = 30
+	}
+	deregisterAtAgents()
+	// HTTP requests and running jobs get their own deadlines, therefore slow
+	// HTTP clients do not take time of the workers
+	stopTimeout := time.Duration(config.StopTimeout) * time.Second
+	sctx, scancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer scancel()
+	err = server.Shutdown(sctx)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("Unable to shutdown HTTP server")
+	}
+	jctx, jcancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer jcancel()
+	err = core.Shutdown(jctx, dispatcher, transporter)
+	if err != nil {
+		logs.WithFields(logs.Fields{
+			"Error": err,
+		}).Error("Unable to persist jobs")
 	}
+	logs.Println("Agent is stopped")
 }
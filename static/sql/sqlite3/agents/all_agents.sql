@@ -0,0 +1 @@
+SELECT alias, url, protocol, backend, capabilities, version, lastseen, state FROM AGENTS
@@ -0,0 +1 @@
+DELETE FROM AGENTS WHERE alias=?
@@ -0,0 +1 @@
+INSERT OR REPLACE INTO AGENTS(alias, url, protocol, backend, capabilities, version, lastseen, state) VALUES(?,?,?,?,?,?,?,?)
@@ -0,0 +1 @@
+SELECT rid, user, roles, decision, comment, ts FROM APPROVALS WHERE rid=? ORDER BY ts, id
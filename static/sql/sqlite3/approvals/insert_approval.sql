@@ -0,0 +1 @@
+INSERT INTO APPROVALS(rid, user, roles, decision, comment, ts) VALUES(?,?,?,?,?,?)
@@ -0,0 +1 @@
+SELECT ts, user, agent, endpoint, method, action, requests, status, outcome FROM AUDIT WHERE ts >= ? AND (? = '' OR user = ?) AND (? = '' OR action LIKE '%' || ? || '%') ORDER BY ts
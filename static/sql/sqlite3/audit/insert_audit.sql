@@ -0,0 +1 @@
+INSERT INTO AUDIT(ts, user, agent, endpoint, method, action, requests, status, outcome) VALUES(?,?,?,?,?,?,?,?,?)
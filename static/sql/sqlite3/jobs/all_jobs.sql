@@ -0,0 +1 @@
+SELECT action, request FROM JOBS ORDER BY id
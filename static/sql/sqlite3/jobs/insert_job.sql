@@ -0,0 +1 @@
+INSERT INTO JOBS(action, request, ts) VALUES(?,?,?)
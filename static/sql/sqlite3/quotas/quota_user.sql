@@ -0,0 +1 @@
+SELECT COALESCE(SUM(CASE WHEN status IN ('pending','processing','transferring') THEN 1 ELSE 0 END),0), COALESCE(SUM(CASE WHEN status IN ('pending','processing','transferring') THEN bytes ELSE 0 END),0), COALESCE(SUM(CASE WHEN ts >= ? AND status != 'rejected' THEN bytes ELSE 0 END),0) FROM REQUESTS WHERE user=? AND COALESCE(parent,'')=''
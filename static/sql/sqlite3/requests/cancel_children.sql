@@ -0,0 +1 @@
+UPDATE REQUESTS SET status = ? WHERE parent = ? AND status IN ('pending','transferring');
@@ -0,0 +1 @@
+SELECT COUNT(*), COALESCE(SUM(CASE WHEN status='finished' THEN 1 ELSE 0 END),0), COALESCE(SUM(CASE WHEN status='error' THEN 1 ELSE 0 END),0), COALESCE(SUM(CASE WHEN status IN ('cancelled','deleted') THEN 1 ELSE 0 END),0), COALESCE(SUM(CASE WHEN status='expired' THEN 1 ELSE 0 END),0), COALESCE(SUM(bytes),0), COALESCE(SUM(CASE WHEN status='finished' THEN bytes ELSE 0 END),0) FROM REQUESTS WHERE parent=?
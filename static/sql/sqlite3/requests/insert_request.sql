@@ -1 +1 @@
-INSERT INTO REQUESTS(rid, lfn, block, dataset, srcurl, srcalias, dsturl, dstalias, regurl, regalias, status, priority) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)
+INSERT INTO REQUESTS(rid, lfn, block, dataset, srcurl, srcalias, dsturl, dstalias, regurl, regalias, status, priority, user, bytes, ts, parent, notbefore, deadline) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
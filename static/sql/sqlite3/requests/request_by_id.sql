@@ -1 +1 @@
-SELECT lfn, block, dataset, srcurl, srcalias, dsturl, dstalias, regurl, regalias, priority INTEGER FROM REQUESTS WHERE rid=?
+SELECT lfn, block, dataset, srcurl, srcalias, dsturl, dstalias, regurl, regalias, priority, COALESCE(user,''), COALESCE(bytes,0), status, COALESCE(parent,''), COALESCE(notbefore,0), COALESCE(deadline,0) FROM REQUESTS WHERE rid=?
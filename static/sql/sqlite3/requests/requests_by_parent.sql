@@ -0,0 +1 @@
+SELECT * FROM REQUESTS WHERE parent=?
@@ -0,0 +1 @@
+UPDATE REQUESTS SET priority = ? WHERE rid = ? OR parent = ?;
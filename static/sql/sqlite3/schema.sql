@@ -1,5 +1,9 @@
 CREATE TABLE FILES(id INTEGER PRIMARY KEY, lfn TEXT UNIQUE, pfn TEXT, blockid INTEGER, datasetid INTEGER, bytes INTEGER, hash TEXT, transfertime INTEGER, timestamp INTEGER, FOREIGN KEY(blockid) REFERENCES BLOCKS(id), FOREIGN KEY(datasetid) REFERENCES DATASETS(id));
 CREATE TABLE DATASETS(id INTEGER PRIMARY KEY, dataset TEXT UNIQUE);
 CREATE TABLE BLOCKS(id INTEGER PRIMARY KEY, block TEXT UNIQUE, datasetid INTEGER, FOREIGN KEY(datasetid) REFERENCES DATASETS(id));
-CREATE TABLE REQUESTS(id INTEGER PRIMARY KEY, rid TEXT, lfn TEXT, block TEXT, dataset TEXT, srcurl TEXT, srcalias TEXT, dsturl TEXT, dstalias TEXT, regurl TEXT, regalias TEXT, status TEXT, priority INTEGER);
+CREATE TABLE REQUESTS(id INTEGER PRIMARY KEY, rid TEXT, lfn TEXT, block TEXT, dataset TEXT, srcurl TEXT, srcalias TEXT, dsturl TEXT, dstalias TEXT, regurl TEXT, regalias TEXT, status TEXT, priority INTEGER, user TEXT, bytes INTEGER, ts INTEGER, parent TEXT, notbefore INTEGER, deadline INTEGER);
 CREATE TABLE TRANSFERS(timestamp INTEGER PRIMARY KEY, cpu REAL, ram REAL, throughput REAL);
+CREATE TABLE AGENTS(id INTEGER PRIMARY KEY, alias TEXT UNIQUE, url TEXT, protocol TEXT, backend TEXT, capabilities TEXT, version TEXT, lastseen INTEGER, state TEXT);
+CREATE TABLE AUDIT(id INTEGER PRIMARY KEY AUTOINCREMENT, ts INTEGER, user TEXT, agent TEXT, endpoint TEXT, method TEXT, action TEXT, requests TEXT, status INTEGER, outcome TEXT);
+CREATE TABLE APPROVALS(id INTEGER PRIMARY KEY AUTOINCREMENT, rid TEXT, user TEXT, roles TEXT, decision TEXT, comment TEXT, ts INTEGER);
+CREATE TABLE JOBS(id INTEGER PRIMARY KEY AUTOINCREMENT, action TEXT, request TEXT, ts INTEGER);
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS AGENTS(id INTEGER PRIMARY KEY, alias TEXT UNIQUE, url TEXT, protocol TEXT, backend TEXT, capabilities TEXT, version TEXT, lastseen INTEGER, state TEXT);
+CREATE TABLE IF NOT EXISTS AUDIT(id INTEGER PRIMARY KEY AUTOINCREMENT, ts INTEGER, user TEXT, agent TEXT, endpoint TEXT, method TEXT, action TEXT, requests TEXT, status INTEGER, outcome TEXT);
+CREATE TABLE IF NOT EXISTS APPROVALS(id INTEGER PRIMARY KEY AUTOINCREMENT, rid TEXT, user TEXT, roles TEXT, decision TEXT, comment TEXT, ts INTEGER);
+CREATE TABLE IF NOT EXISTS JOBS(id INTEGER PRIMARY KEY AUTOINCREMENT, action TEXT, request TEXT, ts INTEGER);
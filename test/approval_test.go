@@ -0,0 +1,55 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestApprovalPolicy test core.ApprovalPolicy rules
+func TestApprovalPolicy(t *testing.T) {
+	policy, err := core.LoadApprovals("config/approvals.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := core.TransferRequest{Id: "1", DstAlias: "T2_Destination", Bytes: 10}
+	large := core.TransferRequest{Id: "2", DstAlias: "T2_Other", Bytes: 2000000000000}
+	other := core.TransferRequest{Id: "3", DstAlias: "T2_Other", Bytes: 10}
+
+	if roles := policy.Required(small); len(roles) != 1 || roles[0] != core.RoleOperator {
+		t.Errorf("Unexpected required roles %v", roles)
+	}
+	if roles := policy.Required(other); len(roles) != 0 {
+		t.Errorf("Unexpected required roles %v", roles)
+	}
+	if missing := policy.Missing(other, nil); len(missing) != 1 {
+		t.Errorf("Request without approvals is approved: %v", missing)
+	}
+
+	operator := core.Approval{User: "/CN=operator", Roles: []string{core.RoleOperator}, Decision: core.Approve}
+	admin := core.Approval{User: "/CN=admin", Roles: []string{core.RoleAdmin}, Decision: core.Approve}
+	if missing := policy.Missing(small, []core.Approval{operator}); len(missing) != 0 {
+		t.Errorf("Operator approval is not enough: %v", missing)
+	}
+	// single approver can not sign off two roles
+	if missing := policy.Missing(large, []core.Approval{admin}); len(missing) != 1 {
+		t.Errorf("Single admin approved multi-party request: %v", missing)
+	}
+	if missing := policy.Missing(large, []core.Approval{admin, operator}); len(missing) != 0 {
+		t.Errorf("Multi-party request is not approved: %v", missing)
+	}
+	// last decision of approver wins
+	withdrawn := operator
+	withdrawn.Decision = core.Reject
+	if missing := policy.Missing(small, []core.Approval{operator, withdrawn}); len(missing) != 1 {
+		t.Errorf("Withdrawn approval is counted: %v", missing)
+	}
+	if _, ok := core.Rejected([]core.Approval{operator, withdrawn}); !ok {
+		t.Error("Rejection is not found")
+	}
+
+	var none *core.ApprovalPolicy
+	if missing := none.Missing(small, []core.Approval{operator}); len(missing) != 0 {
+		t.Errorf("Single approval is not enough without policy: %v", missing)
+	}
+}
@@ -0,0 +1,54 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestAuditLog test core.AuditLog JSON-lines file
+func TestAuditLog(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	alog, err := core.NewAuditLog(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []core.AuditRecord{
+		core.AuditRecord{TimeStamp: 1, User: "/CN=admin", Endpoint: "action", Method: "POST", Action: "approve", Requests: []string{"1", "2"}, Status: 200, Outcome: core.AuditSuccess},
+		core.AuditRecord{TimeStamp: 2, User: "/CN=user", Endpoint: "reset", Method: "POST", Action: "reset", Status: 403, Outcome: core.AuditDenied},
+	}
+	for _, rec := range records {
+		if err := alog.Record(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alog.Close()
+
+	fh, err := os.Open(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	var out []core.AuditRecord
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var rec core.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, rec)
+	}
+	if len(out) != 2 || out[0].Action != "approve" || len(out[0].Requests) != 2 || out[1].Outcome != core.AuditDenied {
+		t.Errorf("Unexpected audit records %v", out)
+	}
+}
@@ -1,7 +1,6 @@
 package test
 
 import (
-	"fmt"
 	"testing"
 
 	//     "github.com/stretchr/testify/assert"
@@ -9,10 +8,6 @@ import (
 	"github.com/vkuznet/transfer2go/core"
 )
 
-func caller(agent, src, dst string) {
-	fmt.Println("caller", agent, src, dst)
-}
-
 // TestAuthDecorator test core.AuthDecorator function
 func TestAuthzDecorator(t *testing.T) {
 	//     assert := assert.New(t)
@@ -22,3 +17,67 @@ func TestAuthzDecorator(t *testing.T) {
 	core.AuthzDecorator(caller, "cms")(agent, src, dst)
 	//     assert.Equal(1, 1, "values should be equal")
 }
+
+// TestPolicy test core.Policy authorization checks
+func TestPolicy(t *testing.T) {
+	policy, err := core.LoadPolicy("config/policy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := core.User{Name: "/DC=ch/DC=cern/OU=Organic Units/OU=Users/CN=admin/CN=000000/CN=Transfer Admin"}
+	agent := core.User{Name: "/DC=ch/DC=cern/OU=computers/CN=agent.cern.ch"}
+	user := core.User{Name: "/DC=ch/DC=cern/OU=Organic Units/OU=Users/CN=user"}
+	policy.Groups["users"] = append(policy.Groups["users"], user.Name)
+
+	if !policy.Endpoint(admin, "POST", "reset") {
+		t.Error("Expect admin to reset agent")
+	}
+	if policy.Endpoint(agent, "POST", "tfc") {
+		t.Error("Expect site-operator to be denied POST tfc by policy rule")
+	}
+	if !policy.Endpoint(agent, "GET", "tfc") || !policy.Endpoint(agent, "POST", "register") {
+		t.Error("Expect site-operator to read tfc and register agents")
+	}
+	if !policy.Endpoint(user, "POST", "request") || policy.Endpoint(user, "POST", "verbose") {
+		t.Error("Expect requester to submit requests only")
+	}
+	if policy.Endpoint(core.User{Name: "unknown"}, "GET", "status") {
+		t.Error("Expect unknown user to be denied")
+	}
+	if policy.Action(user, "approve") || policy.Action(user, "delete") {
+		t.Error("Expect requester to be denied approve and delete actions")
+	}
+	if !policy.Action(agent, "approve") || !policy.Action(agent, "update") {
+		t.Error("Expect site-operator to approve and update requests")
+	}
+	// token users get their roles via scopes and groups
+	if !policy.Endpoint(core.User{Name: "robot", Scopes: []string{"transfer2go.write"}}, "POST", "request") {
+		t.Error("Expect token with transfer2go.write scope to submit requests")
+	}
+	if !policy.Action(core.User{Name: "robot", Groups: []string{"operators"}}, "approve") {
+		t.Error("Expect token user in operators group to approve requests")
+	}
+	if !policy.SiteManager(agent, "T2_Destination") || policy.SiteManager(agent, "T2_Other") {
+		t.Error("Expect site-operator to manage T2_Destination only")
+	}
+	if !policy.SiteManager(admin, "T2_Other") || policy.SiteManager(user, "T2_Destination") {
+		t.Error("Expect admin to manage all sites and requester none")
+	}
+	// agents identified by their host certificates call each other
+	host := core.User{Name: "/DC=ch/DC=cern/OU=computers/CN=host.cern.ch", Agent: "host.cern.ch"}
+	for _, endpoint := range []string{"status", "download", "lfn2pfn", "probe", "links", "history"} {
+		if !policy.Endpoint(host, "GET", endpoint) {
+			t.Errorf("Expect agent to read %s", endpoint)
+		}
+	}
+	if !policy.Endpoint(host, "POST", "records") || !policy.Endpoint(user, "POST", "records") {
+		t.Error("Expect agent and requester to look up records")
+	}
+	if policy.Endpoint(host, "POST", "reset") {
+		t.Error("Expect agent to be denied reset")
+	}
+	var nilPolicy *core.Policy
+	if !nilPolicy.Endpoint(user, "POST", "reset") || !nilPolicy.Action(user, "approve") || !nilPolicy.Admin(user) {
+		t.Error("Expect nil policy to allow everything")
+	}
+}
@@ -0,0 +1,48 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestTransferRegistry test core.TransferRegistry cancellation of transfers
+func TestTransferRegistry(t *testing.T) {
+	registry := core.NewTransferRegistry()
+	child := core.TransferRequest{Id: "child", Parent: "parent"}
+	other := core.TransferRequest{Id: "other"}
+
+	ctx1, done1 := registry.Start(child)
+	ctx2, done2 := registry.Start(other)
+	defer done2()
+	if registry.Running() != 2 {
+		t.Errorf("Unexpected number of running transfers %d", registry.Running())
+	}
+	// cancellation of parent request aborts transfers of derived requests
+	if count := registry.Cancel("parent"); count != 1 {
+		t.Errorf("Unexpected number of cancelled transfers %d", count)
+	}
+	select {
+	case <-ctx1.Done():
+	case <-time.After(time.Second):
+		t.Error("Transfer of derived request is not cancelled")
+	}
+	if ctx2.Err() != nil {
+		t.Error("Unrelated transfer is cancelled")
+	}
+	done1()
+	if registry.Running() != 1 {
+		t.Errorf("Finished transfer is still running")
+	}
+
+	// jobs of cancelled request are discarded
+	if !registry.Cancelled(child) || registry.Cancelled(other) {
+		t.Error("Unexpected cancellation state")
+	}
+	ctx3, done3 := registry.Start(child)
+	defer done3()
+	if ctx3.Err() == nil {
+		t.Error("Transfer of cancelled request is started")
+	}
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/server"
+)
+
+// helper function to find member in a list
+func findMember(alias string, members []server.Member) (server.Member, bool) {
+	for _, m := range members {
+		if m.Alias == alias {
+			return m, true
+		}
+	}
+	return server.Member{}, false
+}
+
+// TestMembership test convergence of gossip membership views
+func TestMembership(t *testing.T) {
+	a := server.NewMembership("")
+	a.Join(server.Member{Alias: "A", Url: "http://a:8000"})
+	b := server.NewMembership("")
+	b.Join(server.Member{Alias: "B", Url: "http://b:8000"})
+	c := server.NewMembership("")
+	c.Join(server.Member{Alias: "C", Url: "http://c:8000"})
+
+	// B joins via A, then C joins via B, A learns about C from B
+	a.Merge(b.List())
+	b.Merge(a.List())
+	b.Merge(c.List())
+	c.Merge(b.List())
+	a.Merge(b.List())
+	for _, ms := range []*server.Membership{a, b, c} {
+		if len(ms.List()) != 3 {
+			t.Errorf("Membership view of %s did not converge: %v", ms.Self, ms.List())
+		}
+	}
+
+	// newer heartbeat of C supersedes older entry
+	c.Beat()
+	updated := a.Merge(c.List())
+	if m, ok := findMember("C", updated); !ok || m.Heartbeat != 1 {
+		t.Errorf("Expect updated entry of C, got %v", updated)
+	}
+	// stale entry is ignored
+	if updated = a.Merge(b.List()); len(updated) != 0 {
+		t.Errorf("Expect no updates from stale view, got %v", updated)
+	}
+
+	// A suspects C is dead, C refutes it with new incarnation
+	a.SetState("C", core.AgentDead)
+	self, _ := findMember("C", c.List())
+	c.Merge(a.List())
+	refuted, _ := findMember("C", c.List())
+	if refuted.Incarnation <= self.Incarnation {
+		t.Error("Expect C to refute its death with new incarnation")
+	}
+	a.Merge(c.List())
+	if m, _ := findMember("C", a.List()); m.State != core.AgentAlive {
+		t.Errorf("Expect C to be alive, got %v", m)
+	}
+
+	// dead member is reaped and its death is not learned back from others
+	a.SetState("C", core.AgentDead)
+	b.Merge(a.List())
+	if reaped := a.Reap(0); len(reaped) != 1 || reaped[0].Alias != "C" {
+		t.Errorf("Expect C to be reaped, got %v", reaped)
+	}
+	a.Merge(b.List())
+	if _, ok := findMember("C", a.List()); ok {
+		t.Error("Expect reaped C to stay removed")
+	}
+}
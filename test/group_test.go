@@ -0,0 +1,37 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestGroupProgress test core.GroupProgress status of parent request
+func TestGroupProgress(t *testing.T) {
+	tests := []struct {
+		progress core.GroupProgress
+		status   string
+	}{
+		{core.GroupProgress{}, ""},
+		{core.GroupProgress{Total: 3, Done: 1, Failed: 1}, "transferring"},
+		{core.GroupProgress{Total: 3, Done: 3}, "finished"},
+		{core.GroupProgress{Total: 3, Done: 2, Failed: 1}, "error"},
+		{core.GroupProgress{Total: 3, Done: 1, Cancelled: 2}, "finished"},
+		{core.GroupProgress{Total: 3, Cancelled: 3}, "cancelled"},
+		{core.GroupProgress{Total: 3, Done: 2, Expired: 1}, "expired"},
+		{core.GroupProgress{Total: 3, Done: 1, Expired: 1}, "transferring"},
+	}
+	for _, test := range tests {
+		if status := test.progress.Status(); status != test.status {
+			t.Errorf("%s: expected status %q, got %q", test.progress.String(), test.status, status)
+		}
+	}
+
+	// derived requests keep reference to their parent
+	parent := core.TransferRequest{Id: "1", Dataset: "/a/b/c"}
+	child := parent.Clone()
+	child.Parent = parent.Id
+	if c := child.Clone(); c.Parent != parent.Id {
+		t.Errorf("Clone does not preserve parent: %s", c.String())
+	}
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestIdentityProviders test core identity providers and registry
+func TestIdentityProviders(t *testing.T) {
+	identities := []core.Identity{
+		core.Identity{DN: "/CN=alice", Groups: []string{"operators"}},
+		core.Identity{DN: "/CN=bob"},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(identities)
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	provider, err := core.NewIdentityProvider("http", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := core.NewIdentityRegistry(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !registry.Known("/CN=alice") || registry.Known("/CN=eve") {
+		t.Error("Expect alice to be known and eve unknown")
+	}
+	if groups := registry.Groups("/CN=alice"); len(groups) != 1 || groups[0] != "operators" {
+		t.Errorf("Expect alice in operators group, got %v", groups)
+	}
+
+	// provider changes its list, reload picks it up
+	identities = append(identities, core.Identity{DN: "/CN=eve"})
+	if err := registry.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !registry.Known("/CN=eve") || registry.Size() != 3 {
+		t.Error("Expect eve to be known after reload")
+	}
+
+	provider, _ = core.NewIdentityProvider("static", "/CN=alice; /CN=bob")
+	registry, _ = core.NewIdentityRegistry(provider)
+	if !registry.Known("/CN=bob") || registry.Size() != 2 {
+		t.Error("Expect static allow-list with two DNs")
+	}
+	if _, err := core.NewIdentityProvider("sitedb", ""); err == nil {
+		t.Error("Expect error for unknown provider")
+	}
+	var none *core.IdentityRegistry
+	if none.Known("/CN=alice") {
+		t.Error("Expect nil registry to deny everybody")
+	}
+}
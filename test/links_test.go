@@ -0,0 +1,68 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestLinkGraph test core.LinkGraph routing functionality
+func TestLinkGraph(t *testing.T) {
+	agents := map[string]string{
+		"T1_A": "http://t1a:8000",
+		"T2_B": "http://t2b:8000",
+		"T3_C": "http://t3c:8000",
+		"T3_D": "http://t3d:8000",
+	}
+	registry := core.NewAgentRegistry()
+	for alias, aurl := range agents {
+		registry.Seen(alias, aurl)
+	}
+	// empty graph represents full mesh
+	graph := core.LinkGraph{Agents: registry}
+	hops, err := graph.Path("T3_C", "T3_D")
+	if err != nil || len(hops) != 0 {
+		t.Errorf("Expect direct link between T3_C and T3_D, got %v, error %v", hops, err)
+	}
+	// T3 sites can only reach T2_B which is connected to T1_A
+	graph.AddLink("T3_C", "T2_B")
+	graph.AddLink("T3_D", "T2_B")
+	graph.AddLink("T2_B", "T1_A")
+	hops, err = graph.Path("T3_C", "T1_A")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(hops) != 1 || hops[0].Alias != "T2_B" || hops[0].Url != agents["T2_B"] {
+		t.Errorf("Expect route through T2_B, got %v", hops)
+	}
+	hops, err = graph.Path("T1_A", "T3_D")
+	if err != nil || len(hops) != 1 || hops[0].Alias != "T2_B" {
+		t.Errorf("Expect route through T2_B, got %v, error %v", hops, err)
+	}
+	// probes found that link between T2_B and T1_A is down in both directions
+	graph.SetHealth("T2_B", "T1_A", false)
+	graph.SetHealth("T1_A", "T2_B", false)
+	if _, err = graph.Path("T3_C", "T1_A"); err == nil {
+		t.Error("Expect no route through unhealthy link")
+	}
+	graph.SetHealth("T1_A", "T2_B", true)
+	if hops, err = graph.Path("T3_C", "T1_A"); err != nil || len(hops) != 1 {
+		t.Errorf("Expect route through T2_B, got %v, error %v", hops, err)
+	}
+	// unknown agent can't be reached
+	if _, err = graph.Path("T3_C", "T4_X"); err == nil {
+		t.Error("Expect no route to unknown agent")
+	}
+
+	// routes avoid slow links, the latency is in ms and throughput in MB/s
+	mesh := core.LinkGraph{Agents: registry}
+	mesh.SetMetrics("T3_C", "T3_D", 10, 1)
+	hops, err = mesh.Path("T3_C", "T3_D")
+	if err != nil || len(hops) != 1 || hops[0].Alias != "T1_A" {
+		t.Errorf("Expect route around slow link through T1_A, got %v, error %v", hops, err)
+	}
+	mesh.SetMetrics("T3_C", "T3_D", 10, 1000)
+	if hops, err = mesh.Path("T3_C", "T3_D"); err != nil || len(hops) != 0 {
+		t.Errorf("Expect direct fast link, got %v, error %v", hops, err)
+	}
+}
@@ -0,0 +1,44 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestQuotas test core.QuotaPolicy limits
+func TestQuotas(t *testing.T) {
+	quotas, err := core.LoadQuotas("config/quotas.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator := "/DC=org/DC=example/OU=People/CN=Operator"
+	if q, ok := quotas.Quota("user", operator); !ok || q.MaxPending != 1000 || q.MaxBytes != 0 {
+		t.Errorf("Unexpected quota of %s: %v", operator, q)
+	}
+	q, ok := quotas.Quota("user", "/CN=user")
+	if !ok || q.MaxPending != 100 {
+		t.Errorf("Default quota is not applied: %v", q)
+	}
+	if _, ok := quotas.Quota("site", "T2_Destination"); !ok {
+		t.Error("No quota for T2_Destination")
+	}
+
+	usage := core.QuotaUsage{Pending: 99, Bytes: 1000, BytesPerDay: 1000}
+	if err := q.Check("user", "/CN=user", usage, 1, 1000); err != nil {
+		t.Errorf("Request within quota is rejected: %v", err)
+	}
+	err = q.Check("user", "/CN=user", usage, 2, 1000)
+	if qerr, ok := err.(*core.QuotaError); !ok || qerr.Limit != "pending requests" || qerr.Value != 101 {
+		t.Errorf("Unexpected error for exceeded pending requests: %v", err)
+	}
+	usage = core.QuotaUsage{BytesPerDay: 10000000000000}
+	if err := q.Check("user", "/CN=user", usage, 1, 1); err == nil {
+		t.Error("Exceeded bytes per day are not detected")
+	}
+
+	var none *core.QuotaPolicy
+	if err := none.Check([]core.TransferRequest{core.TransferRequest{User: "/CN=user"}}); err != nil {
+		t.Errorf("Nil quota policy rejects requests: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestAgentRegistry test core.AgentRegistry functionality
+func TestAgentRegistry(t *testing.T) {
+	registry := core.NewAgentRegistry()
+	events := registry.Subscribe()
+
+	registry.Register(core.AgentRecord{Alias: "A", Url: "http://a:8000", Protocol: "http", Version: "1.0"})
+	if e := <-events; e.Type != core.AgentRegistered || e.Agent.Alias != "A" {
+		t.Errorf("Expect register event of A, got %v", e)
+	}
+	// heartbeat does not override agent meta-data
+	registry.Seen("A", "http://a:8000")
+	if rec, ok := registry.Get("A"); !ok || rec.Protocol != "http" || rec.State != core.AgentAlive {
+		t.Errorf("Expect alive agent A with its meta-data, got %v", rec)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expect no events for heartbeat, got %d", len(events))
+	}
+
+	// deregistration requires matching url
+	if registry.Deregister("A", "http://other:8000") {
+		t.Error("Expect A to be kept with wrong url")
+	}
+	if !registry.Deregister("A", "http://a:8000") {
+		t.Error("Expect A to be deregistered")
+	}
+	if e := <-events; e.Type != core.AgentDeregistered {
+		t.Errorf("Expect deregister event, got %v", e)
+	}
+	if registry.Url("A") != "" || len(registry.Map()) != 0 {
+		t.Errorf("Expect no alive agents, got %v", registry.Map())
+	}
+
+	// agent which missed its heartbeats becomes dead
+	registry.Seen("B", "http://b:8000")
+	<-events
+	time.Sleep(1100 * time.Millisecond)
+	if dead := registry.Check(100 * time.Millisecond); len(dead) != 1 || dead[0].Alias != "B" {
+		t.Errorf("Expect B to be dead, got %v", dead)
+	}
+
+	// dead agents are removed after reap timeout
+	if reaped := registry.Reap(time.Hour); len(reaped) != 0 {
+		t.Errorf("Expect no agents to be reaped yet, got %v", reaped)
+	}
+	if reaped := registry.Reap(time.Second); len(reaped) != 2 {
+		t.Errorf("Expect A and B to be reaped, got %v", reaped)
+	}
+	if _, ok := registry.Get("B"); ok || len(registry.List()) != 0 {
+		t.Errorf("Expect dead agents to be removed from registry, got %v", registry.List())
+	}
+}
@@ -0,0 +1,181 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// helper function to create a job for given lfn and delay
+func delayedJob(lfn string, delay int) core.Job {
+	return core.Job{TransferRequest: core.TransferRequest{Lfn: lfn, Delay: delay}, Action: "transfer"}
+}
+
+// TestJobQueueAdmission tests bounded admission of the job queue
+func TestJobQueueAdmission(t *testing.T) {
+	q := core.NewJobQueue(2)
+	if err := q.Submit(delayedJob("/a", 0), delayedJob("/b", 0), delayedJob("/c", 0)); err != core.ErrQueueFull {
+		t.Errorf("Queue admits jobs beyond its capacity, error=%v", err)
+	}
+	if ready, _ := q.Len(); ready != 0 {
+		t.Errorf("Queue admits part of rejected jobs, ready=%d", ready)
+	}
+	if err := q.Submit(delayedJob("/a", 0), delayedJob("/b", 0)); err != nil {
+		t.Errorf("Queue rejects jobs, error=%v", err)
+	}
+	if err := q.Submit(delayedJob("/c", 0)); err != core.ErrQueueFull {
+		t.Errorf("Full queue admits a job, error=%v", err)
+	}
+	// jobs put on hold are always accepted
+	q.Requeue(delayedJob("/d", 0))
+	if ready, _ := q.Len(); ready != 3 {
+		t.Errorf("Queue does not accept requeued job, ready=%d", ready)
+	}
+}
+
+// TestJobQueueDelay tests that delayed jobs become ready after their delay
+func TestJobQueueDelay(t *testing.T) {
+	q := core.NewJobQueue(0)
+	q.Requeue(delayedJob("/delayed", 1))
+	q.Submit(delayedJob("/ready", 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	job, ok := q.Next(ctx)
+	if !ok || job.TransferRequest.Lfn != "/ready" {
+		t.Errorf("Unexpected job %v", job.String())
+	}
+	start := time.Now()
+	job, ok = q.Next(ctx)
+	if !ok || job.TransferRequest.Lfn != "/delayed" {
+		t.Errorf("Unexpected job %v", job.String())
+	}
+	if time.Since(start) < 500*time.Millisecond {
+		t.Errorf("Delayed job is ready too early")
+	}
+
+	cancel()
+	if _, ok := q.Next(ctx); ok {
+		t.Errorf("Queue returns a job after context is done")
+	}
+}
+
+// helper function to create a job for given lfn and priority
+func priorityJob(lfn string, priority int) core.Job {
+	return core.Job{TransferRequest: core.TransferRequest{Id: lfn, Lfn: lfn, Priority: priority}, Action: "transfer"}
+}
+
+// helper function to get lfns of ready jobs in order they are handed to workers
+func readyJobs(t *testing.T, q *core.JobQueue, n int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var lfns []string
+	for i := 0; i < n; i++ {
+		job, ok := q.Next(ctx)
+		if !ok {
+			t.Fatalf("Queue does not provide job %d", i)
+		}
+		lfns = append(lfns, job.TransferRequest.Lfn)
+	}
+	return lfns
+}
+
+// TestJobQueuePriority tests that jobs are handed to workers by priority and
+// their priority can be changed while they are queued
+func TestJobQueuePriority(t *testing.T) {
+	q := core.NewJobQueue(0)
+	q.Submit(priorityJob("/low", 1), priorityJob("/high", 5), priorityJob("/mid", 3))
+	if lfns := readyJobs(t, q, 3); strings.Join(lfns, ",") != "/high,/mid,/low" {
+		t.Errorf("Jobs are not ordered by priority: %v", lfns)
+	}
+
+	q.Submit(priorityJob("/low", 1), priorityJob("/high", 5))
+	if count := q.Reprioritize("/low", 10); count != 1 {
+		t.Errorf("Unexpected number of reprioritized jobs %d", count)
+	}
+	if lfns := readyJobs(t, q, 2); strings.Join(lfns, ",") != "/low,/high" {
+		t.Errorf("Job priority is not changed: %v", lfns)
+	}
+}
+
+// TestJobQueueAging tests that low priority jobs gain priority while they wait
+func TestJobQueueAging(t *testing.T) {
+	aging := core.PriorityAging
+	defer func() { core.PriorityAging = aging }()
+	core.PriorityAging = 10 * time.Millisecond
+
+	q := core.NewJobQueue(0)
+	q.Submit(priorityJob("/old", 1))
+	time.Sleep(50 * time.Millisecond)
+	q.Submit(priorityJob("/new", 2))
+	if lfns := readyJobs(t, q, 2); strings.Join(lfns, ",") != "/old,/new" {
+		t.Errorf("Waiting job does not gain priority: %v", lfns)
+	}
+
+	// job which is put back keeps its waiting time
+	q.Submit(priorityJob("/held", 1))
+	time.Sleep(50 * time.Millisecond)
+	job, ok := q.Next(context.Background())
+	if !ok {
+		t.Fatal("Queue does not provide held job")
+	}
+	q.Requeue(job)
+	q.Submit(priorityJob("/new", 2))
+	if lfns := readyJobs(t, q, 2); strings.Join(lfns, ",") != "/held,/new" {
+		t.Errorf("Requeued job loses its waiting time: %v", lfns)
+	}
+}
+
+// helper function to create a job of given destination and user
+func flowJob(dst, user string) core.Job {
+	return core.Job{TransferRequest: core.TransferRequest{Lfn: dst, DstAlias: dst, User: user}, Action: "transfer"}
+}
+
+// TestJobQueueFairShare tests that destinations get workers according to their weights
+func TestJobQueueFairShare(t *testing.T) {
+	defer core.AgentShares.Set(core.Shares{})
+
+	q := core.NewJobQueue(0)
+	for i := 0; i < 6; i++ {
+		q.Submit(flowJob("T1", "alice"))
+	}
+	q.Submit(flowJob("T2", "bob"), flowJob("T2", "bob"))
+	if lfns := readyJobs(t, q, 8); strings.Join(lfns, ",") != "T1,T2,T1,T2,T1,T1,T1,T1" {
+		t.Errorf("Destinations do not share workers equally: %v", lfns)
+	}
+
+	err := core.AgentShares.Set(core.Shares{Destinations: map[string]float64{"T1": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		q.Submit(flowJob("T1", "alice"), flowJob("T2", "bob"))
+	}
+	if lfns := readyJobs(t, q, 6); strings.Join(lfns, ",") != "T1,T1,T2,T1,T1,T2" {
+		t.Errorf("Destinations do not share workers according to their weights: %v", lfns)
+	}
+	if flows := q.Flows(); len(flows) != 1 || flows[0].Destination != "T2" || flows[0].Jobs != 2 {
+		t.Errorf("Unexpected flows %+v", flows)
+	}
+	readyJobs(t, q, 2)
+
+	// tiny weights are served in the same proportion
+	err = core.AgentShares.Set(core.Shares{Destinations: map[string]float64{"T1": 2e-300, "*": 1e-300}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		q.Submit(flowJob("T1", "alice"), flowJob("T2", "bob"))
+	}
+	if lfns := readyJobs(t, q, 6); strings.Join(lfns, ",") != "T1,T1,T2,T1,T1,T2" {
+		t.Errorf("Destinations do not share workers according to tiny weights: %v", lfns)
+	}
+
+	err = core.AgentShares.Set(core.Shares{Users: map[string]float64{"alice": -1}})
+	if err == nil {
+		t.Errorf("Negative weight is accepted")
+	}
+}
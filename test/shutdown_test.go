@@ -0,0 +1,29 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestDispatcherShutdown test that dispatcher workers stop when context is cancelled
+func TestDispatcherShutdown(t *testing.T) {
+	core.TransferQueue = core.NewJobQueue(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	d := core.NewDispatcher(3)
+	d.TransferRunner(ctx)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		d.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatcher workers did not stop")
+	}
+}
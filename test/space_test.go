@@ -0,0 +1,78 @@
+package test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// TestDiskSpaceReserve tests reservations of space in the pool
+func TestDiskSpaceReserve(t *testing.T) {
+	pool := os.TempDir()
+	total, free, err := utils.DiskUsage(pool)
+	if err != nil {
+		t.Skip("Unable to get disk usage", err)
+	}
+	s := core.NewDiskSpace(pool)
+	if err = s.SetWatermarks(core.Watermarks{High: 1, Low: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Reserve("a", 1024); err != nil {
+		t.Fatal(err)
+	}
+	// reservation of the same transfer is replaced
+	if err = s.Reserve("a", 1024); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.Status(); status.Reserved != 1024 || status.Total != total {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if err = s.Reserve("b", int64(free)); err != core.ErrNoSpace {
+		t.Errorf("Reservation beyond free space is accepted, error=%v", err)
+	}
+	s.Release("a")
+	if status := s.Status(); status.Reserved != 0 {
+		t.Errorf("Space is not released %+v", status)
+	}
+}
+
+// TestDiskSpaceWatermarks tests that pool does not accept transfers above high watermark
+func TestDiskSpaceWatermarks(t *testing.T) {
+	pool := os.TempDir()
+	total, free, err := utils.DiskUsage(pool)
+	if err != nil || free < 2048 {
+		t.Skip("Unable to get disk usage", err)
+	}
+	used := float64(total-free) / float64(total)
+	// pool is already above its high watermark
+	s := core.NewDiskSpace(pool)
+	if err = s.SetWatermarks(core.Watermarks{High: used / 2, Low: used / 4}); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.Status(); !status.Full {
+		t.Errorf("Status does not report full pool %+v", status)
+	}
+	if err = s.Check(1); err != core.ErrNoSpace {
+		t.Errorf("Pool above high watermark accepts transfers, error=%v", err)
+	}
+	if status := s.Status(); !status.Full {
+		t.Errorf("Pool is not full %+v", status)
+	}
+	// pool accepts transfers again once used space is below low watermark
+	if err = s.SetWatermarks(core.Watermarks{High: 1, Low: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.Status(); status.Full {
+		t.Errorf("Status reports stale full state %+v", status)
+	}
+	// empty path disables space checks
+	s = core.NewDiskSpace("")
+	if err = s.Reserve("a", 1<<62); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err = (core.Watermarks{High: 0.5, Low: 0.9}).Validate(); err == nil {
+		t.Error("Low watermark above high one is accepted")
+	}
+}
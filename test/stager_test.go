@@ -0,0 +1,141 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestStagerHierarchy tests that files with the same name in different
+// directories do not collide in the pool
+func TestStagerHierarchy(t *testing.T) {
+	pool, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pool)
+	stager, err := core.NewStager("filesystem", pool, core.TFC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lfn := range []string{"/store/a/file.root", "/store/b/file.root"} {
+		pfn, _, _, err := core.StoreFile(stager, lfn, strings.NewReader(lfn), 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pfn != filepath.Join(pool, lfn) {
+			t.Errorf("Unexpected pfn %s of %s", pfn, lfn)
+		}
+		if !stager.Exists(lfn) || stager.Status(lfn) != core.StageOnline {
+			t.Errorf("File %s does not exist", lfn)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(pool, "store/a/file.root"))
+	if err != nil || string(data) != "/store/a/file.root" {
+		t.Errorf("File is overwritten %q, error=%v", data, err)
+	}
+	if stager.Exists("/store/a") {
+		t.Error("Directory is reported as a file")
+	}
+
+	// lfn can't escape the pool
+	pfn, _, _, err := core.StoreFile(stager, "/../../escape.root", strings.NewReader("data"), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pfn != filepath.Join(pool, "escape.root") {
+		t.Errorf("Lfn escapes the pool %s", pfn)
+	}
+	if _, err = stager.Create("/.."); err == nil {
+		t.Error("Pool itself is accepted as a file")
+	}
+}
+
+// TestStagerOpen tests reading byte ranges, stat and removal of files in the pool
+func TestStagerOpen(t *testing.T) {
+	pool, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pool)
+	stager := core.NewFileSystemStager(pool, core.TFC)
+	lfn := "/store/data/file.root"
+	if _, _, _, err = core.StoreFile(stager, lfn, strings.NewReader("0123456789"), 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	info, err := stager.Stat(lfn)
+	if err != nil || info.Size() != 10 {
+		t.Fatalf("Unexpected stat %v, error=%v", info, err)
+	}
+	file, err := stager.Open(lfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err = file.ReadAt(buf, 4); err != nil || string(buf) != "456" {
+		t.Errorf("Unexpected range %q, error=%v", buf, err)
+	}
+	file.Close()
+	if err = stager.Remove(lfn); err != nil {
+		t.Fatal(err)
+	}
+	if stager.Exists(lfn) {
+		t.Error("File is not removed")
+	}
+	if _, err = core.NewStager("tape", pool, core.TFC); err == nil {
+		t.Error("Unknown stager is accepted")
+	}
+}
+
+// TestStagerRules tests that trivial file catalog rules of the stager protocol
+// locate files within the pool areas
+func TestStagerRules(t *testing.T) {
+	pool, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pool)
+	data := fmt.Sprintf(`{"lfn-to-pfn": [
+		{"protocol": "direct", "pathMatch": "^/store/(.*)$", "result": "%s/data/$1"},
+		{"protocol": "http", "pathMatch": "^(.*)$", "result": "$1", "chain": "direct"},
+		{"protocol": "evil", "pathMatch": "^/store/(.*)$", "result": "%s/data/$1/../../../$1"},
+		{"protocol": "evil", "pathMatch": "^(.*)$", "result": "%s/../$1"}]}`, pool, pool, pool)
+	fname := filepath.Join(pool, "rules.json")
+	if err = ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := core.LoadRules(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(r *core.Rules) { core.AgentRules = r }(core.AgentRules)
+	core.AgentRules = rules
+
+	stager := core.NewFileSystemStager(filepath.Join(pool, "pool"), core.TFC)
+	stager.Protocol = "http"
+	if roots := stager.Roots(); len(roots) != 2 || roots[1] != filepath.Join(pool, "data") {
+		t.Errorf("Unexpected roots %v", roots)
+	}
+	pfn, _, _, err := core.StoreFile(stager, "/store/a/file.root", strings.NewReader("data"), 0, "")
+	if err != nil || pfn != filepath.Join(pool, "data/a/file.root") {
+		t.Errorf("Unexpected pfn %s, error=%v", pfn, err)
+	}
+	// lfn without matching rule is placed into the pool area
+	pfn, _, _, err = core.StoreFile(stager, "/other/file.root", strings.NewReader("data"), 0, "")
+	if err != nil || pfn != filepath.Join(pool, "pool/other/file.root") {
+		t.Errorf("Unexpected pfn %s, error=%v", pfn, err)
+	}
+	// mapped pfn can't escape the pool areas
+	stager.Protocol = "evil"
+	for _, lfn := range []string{"/store/file.root", "/other/file.root"} {
+		if _, err = stager.Create(lfn); err == nil {
+			t.Errorf("Pfn of %s outside of the pool is accepted", lfn)
+		}
+	}
+}
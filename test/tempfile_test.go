@@ -0,0 +1,86 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestTempFile tests that incoming file appears under its pfn only after commit
+func TestTempFile(t *testing.T) {
+	pool, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pool)
+	pfn := filepath.Join(pool, "file.root")
+
+	f, err := core.CreateTempFile(pfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	if _, err = os.Stat(pfn); !os.IsNotExist(err) {
+		t.Error("File is visible before commit")
+	}
+	if err = f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	f.Discard() // no-op after commit
+	data, err := ioutil.ReadFile(pfn)
+	if err != nil || string(data) != "data" {
+		t.Errorf("Unexpected content %q, error=%v", data, err)
+	}
+
+	// discarded file leaves nothing behind, stale files are removed by janitor
+	f, err = core.CreateTempFile(pfn + ".2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Discard()
+	if _, err = core.CreateTempFile(pfn + ".3"); err != nil {
+		t.Fatal(err)
+	}
+	if count := core.CleanTempFiles(pool); count != 1 {
+		t.Errorf("Janitor removed %d files, expected 1", count)
+	}
+	files, _ := ioutil.ReadDir(pool)
+	if len(files) != 1 || files[0].Name() != "file.root" {
+		t.Errorf("Unexpected files in pool %v", files)
+	}
+}
+
+// TestStoreFileVerify tests that stager does not keep data which fail verification
+func TestStoreFileVerify(t *testing.T) {
+	pool, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pool)
+	stager := core.NewFileSystemStager(pool, core.TFC)
+
+	pfn, bytes, hash, err := core.StoreFile(stager, "/a/b/file.root", strings.NewReader("data"), 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes != 4 || hash == "" {
+		t.Errorf("Unexpected bytes %d and hash %s", bytes, hash)
+	}
+	if data, err := ioutil.ReadFile(pfn); err != nil || string(data) != "data" {
+		t.Errorf("Unexpected content %q, error=%v", data, err)
+	}
+	if _, _, _, err = core.StoreFile(stager, "/a/b/other.root", strings.NewReader("other"), 0, hash); err == nil {
+		t.Error("Data with wrong hash are accepted")
+	}
+	if _, _, _, err = core.StoreFile(stager, "/a/b/other.root", strings.NewReader("other"), 4, ""); err == nil {
+		t.Error("Data with wrong size are accepted")
+	}
+	files, _ := ioutil.ReadDir(pool)
+	if len(files) != 1 {
+		t.Errorf("Unexpected files in pool %v", files)
+	}
+}
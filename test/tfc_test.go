@@ -0,0 +1,62 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestRulesLfn2Pfn tests lfn-to-pfn and pfn-to-lfn rules including chained rules
+func TestRulesLfn2Pfn(t *testing.T) {
+	rules, err := core.LoadRules("config/rules.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		protocol, lfn, pfn string
+	}{
+		{"direct", "/store/data/file.root", "/data/store/data/file.root"},
+		{"http", "/store/temp/file.root", "/scratch/temp/file.root"},
+		{"http", "/store/data/file.root", "/data/store/data/file.root"},
+		{"srmv2", "/store/data/file.root", "srm://se.example.org:8443/srm/managerv2?SFN=/data/store/data/file.root"},
+		{"direct", "/store/../../etc/passwd", ""},
+	}
+	for _, test := range tests {
+		pfn, err := rules.Lfn2Pfn(test.protocol, test.lfn)
+		if test.pfn == "" {
+			if err == nil {
+				t.Errorf("Lfn %s escapes namespace: %s", test.lfn, pfn)
+			}
+			continue
+		}
+		if err != nil || pfn != test.pfn {
+			t.Errorf("Lfn2Pfn(%s, %s) = %s, %v, expected %s", test.protocol, test.lfn, pfn, err, test.pfn)
+		}
+	}
+	lfn, err := rules.Pfn2Lfn("srmv2", "srm://se.example.org:8443/srm/managerv2?SFN=/data/store/data/file.root")
+	if err != nil || lfn != "/store/data/file.root" {
+		t.Errorf("Unexpected lfn %s, error=%v", lfn, err)
+	}
+	if _, err = rules.Lfn2Pfn("gsiftp", "/store/data/file.root"); err == nil {
+		t.Error("Lfn is mapped without rules of the protocol")
+	}
+	if roots := rules.Roots("http"); len(roots) != 2 || roots[0] != "/scratch/temp" || roots[1] != "/data/store" {
+		t.Errorf("Unexpected roots of http rules %v", roots)
+	}
+	// remote pfns do not have local areas
+	if roots := rules.Roots("srmv2"); len(roots) != 0 {
+		t.Errorf("Unexpected roots of srmv2 rules %v", roots)
+	}
+}
+
+// TestDefaultLfn2Pfn tests mapping of lfn into backend area without rules
+func TestDefaultLfn2Pfn(t *testing.T) {
+	pfn, err := core.Lfn2Pfn("http", "/tmp/backend/", "store/../../a/file.root")
+	if err != nil || pfn != "/tmp/backend/a/file.root" {
+		t.Errorf("Unexpected pfn %s, error=%v", pfn, err)
+	}
+	lfn, err := core.Pfn2Lfn("http", "/tmp/backend", pfn)
+	if err != nil || lfn != "/a/file.root" {
+		t.Errorf("Unexpected lfn %s, error=%v", lfn, err)
+	}
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestThrottleConcurrency tests concurrency limits of the agent and of links
+func TestThrottleConcurrency(t *testing.T) {
+	th := core.NewThrottle()
+	limits := core.Limits{Agent: core.Limit{Concurrency: 3}, Links: map[string]core.Limit{"*": {Concurrency: 2}, "A->C": {Concurrency: 1}}}
+	if err := th.Set(limits); err != nil {
+		t.Fatal(err)
+	}
+	r1, err := th.Acquire("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = th.Acquire("A", "B"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = th.Acquire("A", "B"); err != core.ErrTooManyTransfers {
+		t.Errorf("Link concurrency limit is not enforced, error=%v", err)
+	}
+	if _, err = th.Acquire("A", "C"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = th.Acquire("A", "D"); err != core.ErrTooManyTransfers {
+		t.Errorf("Agent concurrency limit is not enforced, error=%v", err)
+	}
+	if status := th.Status(); status.Running["agent"] != 3 || status.Running["A->B"] != 2 {
+		t.Errorf("Unexpected running transfers %v", status.Running)
+	}
+
+	// waiting transfer takes the slot once another transfer is finished
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r1()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err = th.Wait(ctx, "A", "B"); err != nil {
+		t.Errorf("Transfer does not get released slot, error=%v", err)
+	}
+
+	if err = th.Set(core.Limits{Agent: core.Limit{Bandwidth: -1}}); err == nil {
+		t.Errorf("Negative limit is accepted")
+	}
+}
+
+// TestThrottleBandwidth tests bandwidth limit of a link
+func TestThrottleBandwidth(t *testing.T) {
+	th := core.NewThrottle()
+	th.Set(core.Limits{Links: map[string]core.Limit{"A->B": {Bandwidth: 1000}}})
+	ctx := context.Background()
+	start := time.Now()
+	// first second worth of data is sent immediately
+	th.Consume(ctx, "A", "B", 1000)
+	th.Consume(ctx, "A", "C", 1000000)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Data within bandwidth limit are delayed")
+	}
+	th.Consume(ctx, "A", "B", 500)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Bandwidth limit is not enforced, elapsed=%v", elapsed)
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// helper function to create certificate signed by given parent, self-signed if parent is nil
+func makeCert(t *testing.T, serial int64, subject pkix.Name, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// TestVerifyChain test verification of user and proxy certificates against trusted CAs
+func TestVerifyChain(t *testing.T) {
+	ca, caKey := makeCert(t, 1, pkix.Name{CommonName: "Test CA"}, true, nil, nil)
+	userName := pkix.Name{Organization: []string{"Test"}, CommonName: "user"}
+	user, userKey := makeCert(t, 2, userName, false, ca, caKey)
+	// proxy subject is the subject of its issuer with extra CN attribute
+	proxyName := pkix.Name{ExtraNames: append(user.Subject.Names, pkix.AttributeTypeAndValue{Type: []int{2, 5, 4, 3}, Value: "12345"})}
+	proxy, _ := makeCert(t, 3, proxyName, false, user, userKey)
+
+	saved := utils.CACerts
+	defer func() { utils.CACerts = saved }()
+	utils.CACerts = x509.NewCertPool()
+	utils.CACerts.AddCert(ca)
+
+	eec, err := utils.VerifyChain([]*x509.Certificate{proxy, user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eec.SerialNumber.Int64() != 2 {
+		t.Errorf("Expect user certificate to be end-entity, got %v", eec.Subject)
+	}
+	r := &http.Request{TLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{proxy, user}}}
+	if dn := utils.UserDN(r); dn != "/O=Test/CN=user" {
+		t.Errorf("Unexpected user DN %s", dn)
+	}
+
+	// certificate of unknown CA is rejected
+	other, otherKey := makeCert(t, 4, pkix.Name{CommonName: "Other CA"}, true, nil, nil)
+	intruder, _ := makeCert(t, 5, userName, false, other, otherKey)
+	if _, err := utils.VerifyChain([]*x509.Certificate{intruder}); err == nil {
+		t.Error("Expect certificate of unknown CA to be rejected")
+	}
+}
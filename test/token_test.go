@@ -0,0 +1,148 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// helper function to encode data in base64url format
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// helper function to sign token with given algorithm and key
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	hash := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return input + "." + b64(sig)
+}
+
+// TestTokenVerifier test core.TokenVerifier with RSA and EC keys
+func TestTokenVerifier(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+	}}
+	data, _ := json.Marshal(jwks)
+	tmp, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Write(data)
+	tmp.Close()
+
+	verifier, err := core.NewTokenVerifier(tmp.Name(), "https://issuer", "transfer2go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{
+		"sub":   "robot",
+		"iss":   "https://issuer",
+		"aud":   []string{"transfer2go", "other"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "transfer2go.read transfer2go.write",
+	}
+	for kid, key := range map[string]crypto.Signer{"rsa1": rsaKey, "ec1": ecKey} {
+		alg := "RS256"
+		if kid == "ec1" {
+			alg = "ES256"
+		}
+		c, err := verifier.Verify(signToken(t, alg, kid, key, claims))
+		if err != nil {
+			t.Fatalf("Unable to verify %s token: %v", alg, err)
+		}
+		if c.Subject != "robot" || len(c.Scopes()) != 2 {
+			t.Errorf("Unexpected claims %v", c)
+		}
+		if u := c.User(); u.Name != "token:robot" {
+			t.Errorf("Token subject is not namespaced %v", u)
+		}
+	}
+
+	// wrong audience, issuer and expired tokens are rejected
+	claims["aud"] = "other"
+	if _, err := verifier.Verify(signToken(t, "RS256", "rsa1", rsaKey, claims)); err == nil {
+		t.Error("Expect token with wrong audience to be rejected")
+	}
+	claims["aud"] = "transfer2go"
+	claims["iss"] = "https://evil"
+	if _, err := verifier.Verify(signToken(t, "RS256", "rsa1", rsaKey, claims)); err == nil {
+		t.Error("Expect token with wrong issuer to be rejected")
+	}
+	claims["iss"] = "https://issuer"
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	if _, err := verifier.Verify(signToken(t, "RS256", "rsa1", rsaKey, claims)); err == nil {
+		t.Error("Expect expired token to be rejected")
+	}
+	// token signed by another key is rejected
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := verifier.Verify(signToken(t, "RS256", "rsa1", otherKey, claims)); err == nil {
+		t.Error("Expect token with invalid signature to be rejected")
+	}
+	// token with unknown key id is rejected without reloading the keys
+	os.Remove(tmp.Name())
+	if _, err := verifier.Verify(signToken(t, "RS256", "unknown", rsaKey, claims)); err == nil || !strings.Contains(err.Error(), "Unknown key") {
+		t.Errorf("Expect token with unknown key to be rejected, got %v", err)
+	}
+}
+
+// TestTokenHosts tests that bearer token is sent to trusted hosts only
+func TestTokenHosts(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	auth, token, hosts := utils.Auth, utils.Token, utils.TokenHosts
+	defer func() { utils.Auth, utils.Token, utils.TokenHosts = auth, token, hosts }()
+	utils.Auth, utils.Token, utils.TokenHosts = false, "secret", nil
+
+	if _, err := utils.HttpClient().Get(server.URL); err != nil || header != "" {
+		t.Errorf("Token is sent to untrusted host %q, error=%v", header, err)
+	}
+	utils.AddTokenHosts(server.URL)
+	if _, err := utils.HttpClient().Get(server.URL); err != nil || header != "Bearer secret" {
+		t.Errorf("Token is not sent to trusted host %q, error=%v", header, err)
+	}
+}
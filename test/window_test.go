@@ -0,0 +1,66 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// TestTransferWindows tests that transfers are allowed within transfer windows only
+func TestTransferWindows(t *testing.T) {
+	tw := &core.TransferWindows{}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	if !tw.Open(now) || !tw.Next(now).Equal(now) {
+		t.Errorf("Transfers are not allowed without transfer windows")
+	}
+	if err := tw.Set([]core.Window{{Start: "0 22 * * *", Duration: "6h"}}); err != nil {
+		t.Fatal(err)
+	}
+	if tw.Open(now) {
+		t.Errorf("Transfer window is open at %v", now)
+	}
+	night := time.Date(2020, 1, 2, 3, 0, 0, 0, time.Local)
+	if !tw.Open(night) {
+		t.Errorf("Transfer window is closed at %v", night)
+	}
+	expect := time.Date(2020, 1, 1, 22, 0, 0, 0, time.Local)
+	if next := tw.Next(now); !next.Equal(expect) {
+		t.Errorf("Transfer window opens at %v, expect %v", next, expect)
+	}
+	if err := tw.Set([]core.Window{{Start: "0 22 * *", Duration: "6h"}}); err == nil {
+		t.Errorf("Invalid transfer window is accepted")
+	}
+	if err := tw.Set([]core.Window{{Start: "0 0 30 2 *", Duration: "6h"}}); err == nil {
+		t.Errorf("Transfer window which never opens is accepted")
+	}
+}
+
+// TestScheduledJobs tests that scheduled transfers are held by the job queue
+func TestScheduledJobs(t *testing.T) {
+	q := core.NewJobQueue(0)
+	nbf := time.Now().Add(time.Hour).Unix()
+	q.Submit(core.Job{TransferRequest: core.TransferRequest{Lfn: "/nbf", NotBefore: nbf}, Action: "transfer"})
+	q.Submit(core.Job{TransferRequest: core.TransferRequest{Lfn: "/store", NotBefore: nbf}, Action: "store"})
+	if ready, delayed := q.Len(); ready != 1 || delayed != 1 {
+		t.Errorf("Scheduled transfer is not held, ready=%d delayed=%d", ready, delayed)
+	}
+
+	tr := core.TransferRequest{Deadline: time.Now().Add(-time.Second).Unix()}
+	if !tr.Expired() {
+		t.Errorf("Request is not expired after its deadline")
+	}
+
+	// transfer which reaches its deadline while window is closed is held until it expires
+	defer core.AgentWindows.Set(nil)
+	start := fmt.Sprintf("%d * * * *", (time.Now().Minute()+30)%60)
+	if err := core.AgentWindows.Set([]core.Window{{Start: start, Duration: "1m"}}); err != nil {
+		t.Fatal(err)
+	}
+	q = core.NewJobQueue(0)
+	q.Submit(core.Job{TransferRequest: core.TransferRequest{Lfn: "/deadline", Deadline: time.Now().Unix()}, Action: "transfer"})
+	if ready, delayed := q.Len(); ready != 0 || delayed != 1 {
+		t.Errorf("Transfer at its deadline is ready within closed window, ready=%d delayed=%d", ready, delayed)
+	}
+}
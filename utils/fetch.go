@@ -6,7 +6,9 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -50,19 +52,41 @@ var _client = HttpClient()
 // global client's x509 certificates
 var _certs []tls.Certificate
 
-// UserDN function parses user Distinguished Name (DN) from client's HTTP request
-func UserDN(r *http.Request) string {
-	var names []interface{}
-	for _, cert := range r.TLS.PeerCertificates {
-		for _, name := range cert.Subject.Names {
-			switch v := name.Value.(type) {
-			case string:
-				names = append(names, v)
-			}
+// short names of X509 subject attributes used in user DN
+var dnAttributes = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"1.2.840.113549.1.9.1":       "emailAddress",
+}
+
+// helper function to format X509 name as DN, e.g. /DC=ch/DC=cern/OU=Users/CN=user
+func distinguishedName(name pkix.Name) string {
+	var out string
+	for _, attr := range name.Names {
+		key := attr.Type.String()
+		if v, ok := dnAttributes[key]; ok {
+			key = v
 		}
+		out += fmt.Sprintf("/%s=%v", key, attr.Value)
+	}
+	return out
+}
+
+// UserDN function parses user Distinguished Name (DN) from client's HTTP request.
+// The proxy certificates are skipped since their subject is the subject of
+// their issuer with extra CN attribute.
+func UserDN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
 	}
-	parts := names[:7]
-	return fmt.Sprintf("/DC=%s/DC=%s/OU=%s/OU=%s/CN=%s/CN=%s/CN=%s", parts...)
+	cert, _ := endEntity(r.TLS.PeerCertificates)
+	return distinguishedName(cert.Subject)
 }
 
 // client X509 certificates
@@ -115,24 +139,24 @@ func tlsCerts() ([]tls.Certificate, error) {
 	return _certs, nil
 }
 
-// HttpClient provides HTTP client
+// HttpClient provides HTTP client, the client verifies servers against trusted
+// CAs, presents X509 certificates if auth is enabled and sends bearer token to
+// trusted hosts if it is set
 func HttpClient() *http.Client {
-	if Auth == false {
-		return &http.Client{}
-	}
-	// get X509 certs
-	certs, err := tlsCerts()
-	if err != nil {
-		panic(err.Error())
-	}
-	if len(certs) == 0 {
-		return &http.Client{}
+	tlsConfig := &tls.Config{RootCAs: CACerts}
+	if Auth {
+		// get X509 certs
+		certs, err := tlsCerts()
+		if err != nil {
+			panic(err.Error())
+		}
+		tlsConfig.Certificates = certs
 	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{Certificates: certs,
-			InsecureSkipVerify: true},
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
 	}
-	return &http.Client{Transport: tr}
+	return &http.Client{Transport: &tokenTransport{base: tr}}
 }
 
 // String provides string representation for ResponseType
@@ -142,6 +166,11 @@ func (r *ResponseType) String() string {
 
 // FetchResponse fetches data for provided URL, args is a json dump of arguments
 func FetchResponse(rurl string, args []byte) ResponseType {
+	return FetchResponseWithContext(context.Background(), rurl, args)
+}
+
+// FetchResponseWithContext fetches data for provided URL, the request is aborted when given context is cancelled
+func FetchResponseWithContext(ctx context.Context, rurl string, args []byte) ResponseType {
 	startTime := time.Now()
 	var response ResponseType
 	response.Url = rurl
@@ -152,10 +181,10 @@ func FetchResponse(rurl string, args []byte) ResponseType {
 	var req *http.Request
 	var e error
 	if len(args) > 0 {
-		req, e = http.NewRequest("POST", rurl, bytes.NewBuffer(args))
+		req, e = http.NewRequestWithContext(ctx, "POST", rurl, bytes.NewBuffer(args))
 		req.Header.Set("Content-Type", "application/json")
 	} else {
-		req, e = http.NewRequest("GET", rurl, nil)
+		req, e = http.NewRequestWithContext(ctx, "GET", rurl, nil)
 		if e != nil {
 			logs.WithFields(logs.Fields{
 				"Error": e,
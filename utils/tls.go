@@ -0,0 +1,118 @@
+package utils
+
+// transfer2go/utils - Go utilities for transfer2go
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CACerts holds pool of trusted CA certificates, nil pool means that system CAs are used
+var CACerts *x509.CertPool
+
+// LoadCACerts loads CA certificates (PEM files) from given directory and
+// re-initializes global HTTP client to verify servers against them
+func LoadCACerts(dir string) error {
+	if dir != "" {
+		pool := x509.NewCertPool()
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return err
+			}
+			pool.AppendCertsFromPEM(data)
+		}
+		CACerts = pool
+	}
+	_client = HttpClient()
+	return nil
+}
+
+// helper function to check if certificate is a proxy certificate, i.e. its
+// subject is the subject of its issuer with extra CN attribute
+func isProxy(cert *x509.Certificate) bool {
+	return strings.HasPrefix(distinguishedName(cert.Subject), distinguishedName(cert.Issuer)+"/CN=")
+}
+
+// helper function to find end-entity certificate in a chain, i.e. the first
+// certificate which is not a proxy, and its position in the chain
+func endEntity(certs []*x509.Certificate) (*x509.Certificate, int) {
+	for i, cert := range certs {
+		if !isProxy(cert) || i == len(certs)-1 {
+			return cert, i
+		}
+	}
+	return nil, -1
+}
+
+// VerifyChain verifies given certificate chain against trusted CAs and returns
+// its end-entity certificate. The proxy certificates should be signed by their
+// issuer which is next certificate in a chain.
+func VerifyChain(certs []*x509.Certificate) (*x509.Certificate, error) {
+	eec, idx := endEntity(certs)
+	if eec == nil {
+		return nil, errors.New("No client certificate")
+	}
+	now := time.Now()
+	for i := 0; i < idx; i++ {
+		proxy, issuer := certs[i], certs[i+1]
+		if now.Before(proxy.NotBefore) || now.After(proxy.NotAfter) {
+			return nil, fmt.Errorf("Proxy certificate %s is expired", distinguishedName(proxy.Subject))
+		}
+		err := issuer.CheckSignature(proxy.SignatureAlgorithm, proxy.RawTBSCertificate, proxy.Signature)
+		if err != nil {
+			return nil, err
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[idx+1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         CACerts,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	_, err := eec.Verify(opts)
+	return eec, err
+}
+
+// VerifyPeerCertificate verifies client certificates during TLS handshake, it
+// is used instead of tls.RequireAndVerifyClientCert which does not support
+// proxy certificates. Clients without certificates are verified by handlers.
+func VerifyPeerCertificate(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	_, err := VerifyChain(certs)
+	return err
+}
+
+// PeerCertificate returns verified end-entity certificate of HTTP request
+func PeerCertificate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("No client certificate")
+	}
+	return VerifyChain(r.TLS.PeerCertificates)
+}
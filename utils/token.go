@@ -0,0 +1,78 @@
+package utils
+
+// transfer2go/utils - Go utilities for transfer2go
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Token holds bearer token which is sent with HTTP requests to trusted hosts
+var Token string
+
+// TokenHosts lists trusted hosts which receive bearer token, the token is
+// never sent to other hosts
+var TokenHosts []string
+
+// AddTokenHosts adds hosts of given urls (or plain host names) to trusted hosts
+func AddTokenHosts(urls ...string) {
+	for _, v := range urls {
+		host := v
+		if u, err := url.Parse(v); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		}
+		if host != "" && !InList(host, TokenHosts) {
+			TokenHosts = append(TokenHosts, host)
+		}
+	}
+}
+
+// ReadToken returns bearer token from given value which is either a token or
+// a file name with the token. If value is empty the token is read from
+// TRANSFER2GO_TOKEN or from file set by TRANSFER2GO_TOKEN_FILE environment.
+func ReadToken(value string) (string, error) {
+	if value == "" {
+		value = os.Getenv("TRANSFER2GO_TOKEN")
+	}
+	if value == "" {
+		value = os.Getenv("TRANSFER2GO_TOKEN_FILE")
+	}
+	if value == "" {
+		return "", nil
+	}
+	if _, err := os.Stat(value); err == nil {
+		data, err := ioutil.ReadFile(value)
+		if err != nil {
+			return "", err
+		}
+		value = string(data)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// BearerToken returns bearer token from Authorization header of HTTP request
+func BearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	return ""
+}
+
+// tokenTransport adds bearer token to outgoing HTTP requests to trusted hosts
+type tokenTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if Token == "" || req.Header.Get("Authorization") != "" || !InList(req.URL.Hostname(), TokenHosts) {
+		return t.base.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+Token)
+	return t.base.RoundTrip(r)
+}
@@ -18,6 +18,7 @@ import (
 	"text/template"
 
 	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/mem"
 	logs "github.com/sirupsen/logrus"
 )
@@ -256,6 +257,15 @@ func UsedCPU() (float64, error) {
 	return avgUsage / float64(totalCPU), nil
 }
 
+// DiskUsage gets total and free space in bytes of file system of given path
+func DiskUsage(path string) (uint64, uint64, error) {
+	usage, err := disk.Usage(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return usage.Total, usage.Free, nil
+}
+
 // UsedRAM gets used ram
 func UsedRAM() (float64, error) {
 	ram, err := mem.VirtualMemory()